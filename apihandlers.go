@@ -7,19 +7,27 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 var ErrRevokedToken = errors.New("revoked token")
+var ErrTokenReused = errors.New("refresh token was already used, session revoked")
 
 func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	lastSweep := "never"
+	if unix := cfg.sweeper.lastSweep.Load(); unix != 0 {
+		lastSweep = time.Unix(unix, 0).UTC().Format(time.RFC3339)
+	}
+
 	w.Header().Add("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf(`
 		<html><body>
 		<h1>Welcome, Chirpy Admin</h1>
 		<p>Chirpy has been visited %d times!</p>
+		<p>%d expired or revoked tokens collected over %d sweeps, last sweep %s</p>
 		</body></html>
-		`, cfg.fileserverHits)))
+		`, cfg.fileserverHits, cfg.sweeper.collected.Load(), cfg.sweeper.sweeps.Load(), lastSweep)))
 }
 
 func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
@@ -45,6 +53,18 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	respondWithJSON(w, code, errorResponse{Error: msg})
 }
 
+// respondWithValidationErrors responds 400 with everything wrong with the
+// request so a client can show it all at once.
+func respondWithValidationErrors(w http.ResponseWriter, problems []ValidationError) {
+	respondWithJSON(w, http.StatusBadRequest, struct{
+		Error string `json:"error"`
+		Details []ValidationError `json:"details"`
+	}{
+		Error: "Invalid parameters",
+		Details: problems,
+	})
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Personal api keys are sent as bearer tokens in place of an access token,
+// and stored by hashToken.
+
+const apiKeyPrefix = "chirpy_"
+const maxAPIKeyLifetime = 365 * 24 * time.Hour
+
+func (cfg *apiConfig) apiKeyPostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+		Scopes []string `json:"scopes"`
+		// seconds until the key stops working
+		ExpiresIn int `json:"expires_in"`
+	}
+
+	user, _ := UserFromContext(r.Context())
+	if !cfg.requireVerified(w, user, verifiedAPIKeys) { return }
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	// a key can't do more than whatever is creating it, or a token with just
+	// account:write could mint itself an admin key
+	granted := ScopesFromContext(r.Context())
+	for _, scope := range params.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown scope %q", scope))
+			return
+		}
+		if !slices.Contains(granted, scope) {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("Can't grant the %s scope, this token doesn't have it", scope))
+			return
+		}
+	}
+
+	lifetime := time.Duration(params.ExpiresIn) * time.Second
+	if lifetime <= 0 || lifetime > maxAPIKeyLifetime {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("expires_in must be between 1 and %d seconds", int(maxAPIKeyLifetime.Seconds())))
+		return
+	}
+
+	scopes := slices.Clone(params.Scopes)
+	slices.Sort(scopes)
+
+	now := cfg.now().UTC()
+	secret := apiKeyPrefix + randomToken(32)
+	key := APIKey{
+		Id: randomToken(8),
+		UserId: user.Id,
+		Name: params.Name,
+		Scopes: slices.Compact(scopes),
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+
+	err = cfg.db.CreateAPIKey(hashToken(secret), key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the key itself is only ever shown here
+	respondWithJSON(w, http.StatusCreated,
+		struct{
+			APIKey
+			Key string `json:"key"`
+		}{
+			APIKey: key,
+			Key: secret,
+		})
+}
+
+func (cfg *apiConfig) apiKeysGetHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+
+	keys, err := cfg.db.GetAPIKeys(user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (cfg *apiConfig) apiKeyDeleteIdHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+
+	err := cfg.db.DeleteAPIKey(user.Id, chi.URLParam(r, "id"))
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "No such api key")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/golang-jwt/jwt/v5"
 )
 
 
+const refreshTokenLifetime = time.Duration(60 * 24) * time.Hour
+
 func (cfg *apiConfig) loginPostHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
@@ -25,45 +30,109 @@ func (cfg *apiConfig) loginPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserFromEmail(params.Email)
+	keys := loginKeys(params.Email, r)
+	if !cfg.checkLoginAllowed(w, keys) { return }
+
+	user, err := cfg.checkPassword(keys, params.Email, params.Password)
+	if errors.Is(err, ErrBadCredentials) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password))
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "passwords don't match")
+	if user.TOTP.Enabled {
+		cfg.respondWithMFAChallenge(w, user)
 		return
 	}
+	cfg.completeLogin(w, r, user)
+}
+
+var ErrBadCredentials = errors.New("incorrect email or password")
+
+// checkPassword returns the user with email if password is theirs, counting
+// a failed login against keys if not. An unknown email and a wrong password
+// both give ErrBadCredentials and take about as long.
+func (cfg *apiConfig) checkPassword(keys [][2]string, email, password string) (User, error) {
+	user, err := cfg.db.GetUserFromEmail(email)
+	if errors.Is(err, ErrNotExist) {
+		verifyPassword(cfg.limiter.dummyHash, password)
+		cfg.limiter.fail(keys, cfg.now())
+		return User{}, ErrBadCredentials
+	}
+	if err != nil { return User{}, err }
+
+	ok, err := verifyPassword(user.Password, password)
+	if err != nil { return User{}, err }
+	if !ok {
+		cfg.limiter.fail(keys, cfg.now())
+		return User{}, ErrBadCredentials
+	}
+
+	// this is the only time the password is at hand, so it's when a hash
+	// made with an old algorithm or cost gets replaced
+	if !cfg.hasher.Current(user.Password) {
+		hash, err := cfg.hasher.Hash(password)
+		if err == nil { err = cfg.db.SetUserPassword(user.Id, hash) }
+		if err != nil {
+			log.Printf("Error rehashing password for user %d: %s", user.Id, err)
+		} else {
+			user.Password = hash
+		}
+	}
+	return user, nil
+}
+
+// completeLogin starts a new session for a user who has proven who they are
+// and responds with its tokens.
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, user User) {
+	cfg.limiter.clear(lockoutAccount, normalizeEmail(user.Email))
 
 	idStr := strconv.Itoa(user.Id)
-	jwtAccessToken := generateJWT("access", idStr)
-	jwtRefreshToken := generateJWT("refresh", idStr)
+	jwtAccessToken := cfg.generateJWT("access", idStr, allScopes...)
 
-	accessToken, err := jwtAccessToken.SignedString([]byte(cfg.jwtSecret))
+	accessToken, err := cfg.keys.SignedString(jwtAccessToken)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	refreshToken, err := jwtRefreshToken.SignedString([]byte(cfg.jwtSecret))
+	refreshToken, expiresAt, err := cfg.signRefreshToken(idStr, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := cfg.now().UTC()
+	err = cfg.db.AddToken(refreshToken, RefreshToken{
+		Family: randomToken(16),
+		ExpiresAt: expiresAt,
+		UserId: user.Id,
+		CreatedAt: now,
+		LastUsedAt: now,
+		UserAgent: r.UserAgent(),
+		IP: clientIP(r),
+	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	cfg.db.AddToken(refreshToken)
 
 	respondWithJSON(w, http.StatusOK, 
 		struct{
 			Id int `json:"id"`
 			Email string `json:"email"`
 			IsChirpyRed bool `json:"is_chirpy_red"`
+			Role string `json:"role"`
+			Verified bool `json:"verified"`
 			Token string `json:"token"`
 			RefreshToken string `json:"refresh_token"`
 		}{
 			Id: user.Id,
 			Email: user.Email,
 			IsChirpyRed: user.IsChirpyRed,
+			Role: user.Role,
+			Verified: user.Verified,
 			Token: accessToken,
 			RefreshToken: refreshToken,
 		},
@@ -77,14 +146,54 @@ func (cfg *apiConfig) refreshPostHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	id, err := cfg.validateJWT(tok, "refresh", cfg.jwtSecret)
+	// the store decides whether the token can still be used, since a
+	// rotated one has to be seen to catch it being replayed
+	claims, err := cfg.parseJWT(tok, "refresh")
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
+	if claims.ClientId != "" {
+		respondWithError(w, http.StatusUnauthorized, "token belongs to an OAuth client, use /oauth/token")
+		return
+	}
+	id := claims.Subject
 
-	jwtAccessToken := generateJWT("access", id)
-	accessToken, err := jwtAccessToken.SignedString([]byte(cfg.jwtSecret))
+	refreshToken, expiresAt, err := cfg.signRefreshToken(id, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	userId, err := strconv.Atoi(id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = cfg.db.RotateToken(tok, refreshToken, RefreshToken{
+		ExpiresAt: expiresAt,
+		UserId: userId,
+		LastUsedAt: cfg.now().UTC(),
+		UserAgent: r.UserAgent(),
+		IP: clientIP(r),
+	})
+	if errors.Is(err, ErrTokenReused) {
+		log.Printf("Refresh token reused for user %s, revoked its family", id)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if errors.Is(err, ErrRevokedToken) || errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, ErrRevokedToken.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jwtAccessToken := cfg.generateJWT("access", id, allScopes...)
+	accessToken, err := cfg.keys.SignedString(jwtAccessToken)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -93,8 +202,10 @@ func (cfg *apiConfig) refreshPostHandler(w http.ResponseWriter, r *http.Request)
 	respondWithJSON(w, http.StatusOK,
 		struct{
 			Token string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
 		}{
 			Token: accessToken,
+			RefreshToken: refreshToken,
 		})
 }
 
@@ -114,52 +225,146 @@ func (cfg *apiConfig) revokePostHandler(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 }
 
-func (cfg *apiConfig) validateJWT(tokenString, tokenType, secret string) (string, error) {
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&jwt.RegisteredClaims{},
-		func(t *jwt.Token) (interface{}, error) { return []byte(secret), nil },
-	)
-	if err != nil { return "", err }
+// tokenClaims are what's in the tokens we sign. Scope is a space separated
+// list like in OAuth, set on access tokens and on refresh tokens issued to
+// OAuth clients. ClientId is only set on tokens issued to OAuth clients.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+}
 
-	id, err := token.Claims.GetSubject()
-	if err != nil { return "", err }
-	
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil { return "", err }
+func (c tokenClaims) scopes() []string {
+	return strings.Fields(c.Scope)
+}
 
-	if issuer != "chirpy-" + tokenType {
-		return "", errors.New("invalid token type")
-	}
+func (cfg *apiConfig) validateJWT(tokenString, tokenType string) (tokenClaims, error) {
+	claims, err := cfg.parseJWT(tokenString, tokenType)
+	if err != nil { return tokenClaims{}, err }
 
 	if tokenType == "refresh" && !cfg.db.ValidToken(tokenString) {
-		return "", ErrRevokedToken
+		return tokenClaims{}, ErrRevokedToken
+	}
+
+	return claims, nil
+}
+
+// parseJWT checks the signature, expiry and type of a token and returns its
+// claims, without looking at whether the store still accepts it.
+func (cfg *apiConfig) parseJWT(tokenString, tokenType string) (tokenClaims, error) {
+	claims := tokenClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claims,
+		cfg.verificationKey,
+		jwt.WithValidMethods([]string{ AlgEdDSA, AlgRS256, jwt.SigningMethodHS256.Alg() }),
+		jwt.WithTimeFunc(cfg.now),
+	)
+	if err != nil { return tokenClaims{}, err }
+
+	if claims.Issuer != "chirpy-" + tokenType {
+		return tokenClaims{}, errors.New("invalid token type")
 	}
 
-	return id, nil
+	return claims, nil
+}
+
+// signRefreshToken returns a new refresh token for user id and when it
+// expires. It still has to be recorded in the store to be usable. clientId
+// and scopes are only given for tokens issued to OAuth clients.
+func (cfg *apiConfig) signRefreshToken(id, clientId string, scopes ...string) (string, time.Time, error) {
+	jwtRefreshToken := forClient(cfg.generateJWT("refresh", id, scopes...), clientId)
+	refreshToken, err := cfg.keys.SignedString(jwtRefreshToken)
+	if err != nil { return "", time.Time{}, err }
+
+	expiresAt, err := jwtRefreshToken.Claims.GetExpirationTime()
+	if err != nil { return "", time.Time{}, err }
+
+	return refreshToken, expiresAt.Time, nil
+}
+
+// verificationKey finds the key a token was signed with. Tokens from before
+// the switch to key sets have no kid and are checked against JWT_SECRET, but
+// only until JWT_SECRET_UNTIL.
+func (cfg *apiConfig) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid != "" { return cfg.keys.verificationKey(kid, t.Method.Alg()) }
+
+	if t.Method.Alg() != jwt.SigningMethodHS256.Alg() || cfg.jwtSecret == "" ||
+		!cfg.now().Before(cfg.jwtSecretUntil) {
+		return nil, ErrUnknownKey
+	}
+	return []byte(cfg.jwtSecret), nil
 }
 
-func generateJWT(tokenType, id string) *jwt.Token {
+// generateJWT builds the claims for a token, the method it's created with is
+// replaced by the signing key's when it's signed. scopes are what an access
+// token may be used for, on a refresh token they're what the access tokens
+// it's exchanged for get, which only matters for OAuth clients.
+func (cfg *apiConfig) generateJWT(tokenType, id string, scopes ...string) *jwt.Token {
+	now := cfg.now().UTC()
 	switch tokenType {
 	case "access":
-		return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-			Issuer: "chirpy-access",
-			IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Hour)),
-			Subject: id,
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer: "chirpy-access",
+				IssuedAt: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				Subject: id,
+			},
+			Scope: strings.Join(scopes, " "),
+		})
+	case "mfa":
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer: "chirpy-mfa",
+				IssuedAt: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(mfaChallengeLifetime)),
+				Subject: id,
+			},
 		})
 	case "refresh":
-		return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-			Issuer: "chirpy-refresh",
-			IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(60 * 24) * time.Hour)),
-			Subject: id,
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer: "chirpy-refresh",
+				IssuedAt: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(refreshTokenLifetime)),
+				Subject: id,
+				// tokens for the same user in the same second would
+				// otherwise be identical, and every refresh token has to be
+				// unique
+				ID: randomToken(16),
+			},
+			Scope: strings.Join(scopes, " "),
 		})
 	default:
 		return nil
 	}
 }
 
+// clientIP is the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { return r.RemoteAddr }
+	return host
+}
+
+// randomToken returns n random bytes hex encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// hashToken is how random tokens handed to users are stored. They're random
+// enough that a plain sha256 is fine, and it lets them be looked up by hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
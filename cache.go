@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+type DBOptions struct {
+	// SyncInterval batches fsyncs of the log. Zero syncs every write before
+	// returning, otherwise writes made in the last interval can be lost if
+	// the machine goes down.
+	SyncInterval time.Duration
+	// WatchFile makes the DB notice when the files are changed by something
+	// other than itself and reload them before the next read or write.
+	WatchFile bool
+	// Keys encrypts the files at rest when set.
+	Keys *KeyRing
+}
+
+type fileStamp struct {
+	size int64
+	modTime time.Time
+}
+
+func stampOf(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil { return fileStamp{} }
+	return fileStamp{ size: info.Size(), modTime: info.ModTime() }
+}
+
+// load replaces the in memory state with what's on disk. Callers must hold
+// db.mu for writing.
+func (db *DB) load() error {
+	dbs, n, err := db.readState()
+	if err != nil { return err }
+
+	migrated, err := db.migrate(&dbs)
+	if err != nil { return err }
+
+	// the log may have been replaced rather than appended to, so don't keep
+	// writing to the old one
+	logFile, err := os.OpenFile(db.logPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil { return err }
+	if db.log != nil {
+		db.log.Sync()
+		db.log.Close()
+	}
+	db.log = logFile
+
+	db.state = dbs
+	db.indexes = buildIndexes(dbs)
+	db.logRecords = n
+	db.stampFiles()
+
+	// get the migrated state on disk before anything is logged against it,
+	// and move anything sealed with an old key over to the current one
+	if migrated || db.stale { return db.compact() }
+	return nil
+}
+
+// stampFiles remembers what the files looked like after our own writes so
+// that changes made by anyone else can be spotted.
+func (db *DB) stampFiles() {
+	db.stamps = [2]fileStamp{ stampOf(db.path), stampOf(db.logPath()) }
+}
+
+func (db *DB) changedOnDisk() bool {
+	return db.stamps != [2]fileStamp{ stampOf(db.path), stampOf(db.logPath()) }
+}
+
+func (db *DB) reloadIfChanged() error {
+	db.mu.RLock()
+	changed := db.changedOnDisk()
+	db.mu.RUnlock()
+	if !changed { return nil }
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// someone else may have reloaded while we waited for the lock
+	if !db.changedOnDisk() { return nil }
+	return db.load()
+}
+
+func (db *DB) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !db.dirty.Swap(false) { continue }
+
+			// load can swap the log out from under us, so only read it with
+			// the lock held. Syncing happens outside it so writers don't wait
+			// on the disk, and a log closed in the meantime was synced first.
+			db.mu.RLock()
+			logFile := db.log
+			db.mu.RUnlock()
+			if err := logFile.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error syncing database log: %s", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// Close flushes anything still waiting on a batched sync and releases the
+// log file. Closing more than once does nothing.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed { return nil }
+	db.closed = true
+	close(db.done)
+
+	err := db.log.Sync()
+	if cerr := db.log.Close(); err == nil { err = cerr }
+	return err
+}
@@ -15,23 +15,8 @@ func (cfg *apiConfig) chirpPostHandler(w http.ResponseWriter, r *http.Request) {
 		Body string	`json:"body"`
 	}
 
-	tok, err := GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	idStr, err := cfg.validateJWT(tok, "access", cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
+	user, _ := UserFromContext(r.Context())
+	if !cfg.requireVerified(w, user, verifiedChirps) { return }
 
 	params, err := decodeParameters[parameters](r)
 	if err != nil {
@@ -46,7 +31,7 @@ func (cfg *apiConfig) chirpPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	cleaned := clean(params.Body)
 
-	chirp, err := cfg.db.CreateChirp(id, cleaned)
+	chirp, err := cfg.db.CreateChirp(user.Id, cleaned)
 	if err != nil {
 		msg := fmt.Sprintf("Couldn't create chirp: %s", err)
 		respondWithError(w, http.StatusInternalServerError, msg)
@@ -56,20 +41,18 @@ func (cfg *apiConfig) chirpPostHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *apiConfig) chirpGetHandler(w http.ResponseWriter, r *http.Request) {
-	chirps, err := cfg.db.GetChirps()
+	var chirps []Chirp
+	var err error
 	idStr := r.URL.Query().Get("author_id")
 	if idStr != "" {
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-		}
-		trimmed := []Chirp{}
-		for _, chirp := range chirps {
-			if chirp.AuthorId == id {
-				trimmed = append(trimmed, chirp)
-			}
+		id, convErr := strconv.Atoi(idStr)
+		if convErr != nil {
+			respondWithError(w, http.StatusBadRequest, convErr.Error())
+			return
 		}
-		chirps = trimmed
+		chirps, err = cfg.db.GetChirpsByAuthor(id)
+	} else {
+		chirps, err = cfg.db.GetChirps()
 	}
 
 	sortStr := r.URL.Query().Get("sort")
@@ -102,31 +85,14 @@ func (cfg *apiConfig) chirpGetIdHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (cfg *apiConfig) chirpDeleteIdHandler(w http.ResponseWriter, r *http.Request) {
-
-	tok, err := GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	idStr, err := cfg.validateJWT(tok, "access", cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	authorId, err := strconv.Atoi(idStr)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
+	user, _ := UserFromContext(r.Context())
 
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 	}
 
-	if !cfg.db.IsChirpAuthor(authorId, id) {
+	if !user.hasRole(RoleModerator) && !cfg.db.IsChirpAuthor(user.Id, id) {
 		respondWithError(w, http.StatusForbidden, "Not author of chirp")
 		return
 	}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `usage: myserver [command]
+
+With no command the server is started.
+
+commands:
+  snapshot                  take a snapshot of the json database
+  snapshots                 list snapshots
+  restore <name> <db path>  restore a snapshot into a new database file
+  create-admin <email> <password>
+                            create an admin user, or make an existing
+                            user with that email an admin`
+
+// runCommand runs one of the maintenance commands. The snapshot ones work on
+// the files directly, so they're safe to use while the server is running.
+func runCommand(args []string) error {
+	if args[0] == "create-admin" {
+		if len(args) != 3 { return errors.New(usage) }
+		return createAdmin(args[1], args[2])
+	}
+
+	if driver := os.Getenv("DB_DRIVER"); driver != "" && driver != DriverJSON {
+		return fmt.Errorf("snapshots are only supported for the %s driver", DriverJSON)
+	}
+
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" { dbPath = defaultJSONPath }
+
+	dbOpts, err := dbOptionsFromEnv()
+	if err != nil { return err }
+
+	source := fileSnapshotSource{ path: dbPath, keys: dbOpts.Keys }
+	snapshots, _, err := snapshotManagerFromEnv(source)
+	if err != nil { return err }
+
+	switch args[0] {
+	case "snapshot":
+		info, err := snapshots.Create(snapshotManual)
+		if err != nil { return err }
+
+		fmt.Printf("%s  %s\n", info.Checksum, info.Name)
+		return nil
+
+	case "snapshots":
+		list, err := snapshots.List()
+		if err != nil { return err }
+
+		for _, info := range list {
+			fmt.Printf("%s\t%s\t%d\t%s\n",
+				info.Name, info.Kind, info.Size, info.Checksum)
+		}
+		return nil
+
+	case "restore":
+		if len(args) != 3 { return errors.New(usage) }
+
+		path, err := snapshots.Path(args[1])
+		if err != nil { return err }
+
+		db, err := RestoreSnapshot(path, args[2], dbOpts)
+		if err != nil { return err }
+
+		fmt.Printf("Restored %s to %s\n", args[1], args[2])
+		return db.Close()
+
+	default:
+		return errors.New(usage)
+	}
+}
+
+// createAdmin bootstraps the first admin, who can then hand out roles over
+// the api. It writes through a store of its own, so with the json driver the
+// server must not be running.
+func createAdmin(email, password string) error {
+	dbOpts, err := dbOptionsFromEnv()
+	if err != nil { return err }
+
+	db, err := OpenStore(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), dbOpts)
+	if err != nil { return err }
+	defer db.Close()
+
+	hasher, err := passwordHasherFromEnv()
+	if err != nil { return err }
+
+	user, err := db.GetUserFromEmail(email)
+	if errors.Is(err, ErrNotExist) {
+		// held to the same policy as everyone else, it's the account that
+		// most needs a good password
+		policy, err := passwordPolicyFromEnv()
+		if err != nil { return err }
+		if !validEmail(email) { return fmt.Errorf("invalid email address %q", email) }
+		if problems := policy.Check(password, email); len(problems) > 0 {
+			messages := []string{}
+			for _, problem := range problems {
+				messages = append(messages, problem.Message)
+			}
+			return errors.New(strings.Join(messages, "; "))
+		}
+
+		encPass, err := hasher.Hash(password)
+		if err != nil { return err }
+
+		user, err = db.CreateUser(email, encPass)
+		if err != nil { return err }
+
+		// there's no mail to verify with yet, whoever runs this vouches for it
+		err = db.VerifyUser(user.Id)
+		if err != nil { return err }
+		fmt.Printf("Created user %d\n", user.Id)
+	} else if err != nil {
+		return err
+	} else {
+		fmt.Printf("User %d already exists, password left unchanged\n", user.Id)
+	}
+
+	err = db.SetUserRole(user.Id, RoleAdmin)
+	if err != nil { return err }
+
+	fmt.Printf("%s is now an admin\n", email)
+	return nil
+}
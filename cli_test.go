@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestCreateAdminChecksPassword checks the first admin is held to the
+// password policy like any other account.
+func TestCreateAdminChecksPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	t.Setenv("DB_DRIVER", DriverJSON)
+	t.Setenv("DB_PATH", path)
+
+	if err := createAdmin("admin@b.c", "password"); err == nil { t.Fatal("a banned password was accepted") }
+	if err := createAdmin("admin@b.c", "correct horse battery staple"); err != nil { t.Fatal(err) }
+
+	db := openTestDB(t, path, DBOptions{})
+	defer db.Close()
+	user, err := db.GetUserFromEmail("admin@b.c")
+	if err != nil { t.Fatal(err) }
+	if user.Role != RoleAdmin { t.Fatalf("user has role %s, want admin", user.Role) }
+	// the refused attempt mustn't have made the user with its password
+	if ok, err := verifyPassword(user.Password, "correct horse battery staple"); err != nil || !ok {
+		t.Fatalf("admin doesn't have the accepted password: %v", err)
+	}
+}
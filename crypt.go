@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encrypted snapshots start with a header line naming the key they were
+// sealed with, followed by the nonce and ciphertext. Encrypted log records
+// are single lines of the form enc:<key id>:<base64 nonce and ciphertext>.
+// Once a key is set plain json is refused, since anyone able to write to the
+// files could otherwise slip in records that were never sealed. Turning
+// encryption on for an existing database takes DB_ENCRYPTION_MIGRATE=true
+// for one start, which reads the plain files and rewrites them under the
+// current key straight away.
+
+const snapshotMagic = "chirpy-enc-v1 "
+const logRecordPrefix = "enc:"
+
+var ErrWrongKey = errors.New("wrong database encryption key")
+var ErrNotEncrypted = errors.New(
+	"database isn't encrypted, set DB_ENCRYPTION_MIGRATE=true once to encrypt it")
+
+// KeyRing holds the key new data is encrypted with and any older keys that
+// can still be used to read data written before a rotation. A nil KeyRing
+// reads and writes plain json.
+type KeyRing struct {
+	current *dbKey
+	keys map[string]*dbKey
+	// migrating lets plain json be read while encrypting
+	migrating bool
+}
+
+type dbKey struct {
+	id string
+	aead cipher.AEAD
+}
+
+// NewKeyRing takes base64 encoded 32 byte keys. current may be empty to
+// write plain json again while still reading data sealed with the old keys.
+// migrating allows reading plain json with a current key, to encrypt a
+// database that wasn't before.
+func NewKeyRing(current string, old []string, migrating bool) (*KeyRing, error) {
+	ring := &KeyRing{ keys: make(map[string]*dbKey), migrating: migrating }
+
+	for i, encoded := range append([]string{ current }, old...) {
+		if encoded == "" { continue }
+
+		key, err := newDBKey(encoded)
+		if err != nil { return nil, err }
+
+		ring.keys[key.id] = key
+		if i == 0 { ring.current = key }
+	}
+	return ring, nil
+}
+
+func newDBKey(encoded string) (*dbKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil { return nil, fmt.Errorf("decoding encryption key: %w", err) }
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil { return nil, err }
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil { return nil, err }
+
+	sum := sha256.Sum256(raw)
+	return &dbKey{ id: hex.EncodeToString(sum[:4]), aead: aead }, nil
+}
+
+func (k *dbKey) seal(plain []byte, purpose string) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil { return nil, err }
+
+	return k.aead.Seal(nonce, nonce, plain, []byte(purpose)), nil
+}
+
+func (k *dbKey) open(sealed []byte, purpose string) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(sealed) < size { return nil, ErrWrongKey }
+
+	plain, err := k.aead.Open(nil, sealed[:size], sealed[size:], []byte(purpose))
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't decrypt data sealed with key %s", ErrWrongKey, k.id)
+	}
+	return plain, nil
+}
+
+func (ring *KeyRing) key(id string) (*dbKey, error) {
+	if ring != nil {
+		if key, ok := ring.keys[id]; ok { return key, nil }
+	}
+	return nil, fmt.Errorf("%w: data is sealed with key %s which isn't configured", ErrWrongKey, id)
+}
+
+func (ring *KeyRing) encrypting() bool {
+	return ring != nil && ring.current != nil
+}
+
+// plainAllowed reports whether unencrypted data can be read.
+func (ring *KeyRing) plainAllowed() bool {
+	return !ring.encrypting() || ring.migrating
+}
+
+// fresh reports whether data sealed with key id (empty for plain json)
+// matches what would be written now.
+func (ring *KeyRing) fresh(id string) bool {
+	if !ring.encrypting() { return id == "" }
+	return id == ring.current.id
+}
+
+func (ring *KeyRing) sealSnapshot(plain []byte) ([]byte, error) {
+	if !ring.encrypting() { return plain, nil }
+
+	sealed, err := ring.current.seal(plain, "snapshot")
+	if err != nil { return nil, err }
+
+	header := []byte(snapshotMagic + ring.current.id + "\n")
+	return append(header, sealed...), nil
+}
+
+// openSnapshot also returns the id of the key the snapshot was sealed with.
+func (ring *KeyRing) openSnapshot(dat []byte) ([]byte, string, error) {
+	rest, ok := bytes.CutPrefix(dat, []byte(snapshotMagic))
+	if !ok {
+		if !ring.plainAllowed() { return nil, "", ErrNotEncrypted }
+		return dat, "", nil
+	}
+
+	id, sealed, ok := bytes.Cut(rest, []byte("\n"))
+	if !ok { return nil, "", errors.New("malformed encrypted snapshot") }
+
+	key, err := ring.key(string(id))
+	if err != nil { return nil, "", err }
+
+	plain, err := key.open(sealed, "snapshot")
+	return plain, key.id, err
+}
+
+func (ring *KeyRing) sealRecord(plain []byte) ([]byte, error) {
+	if !ring.encrypting() { return plain, nil }
+
+	sealed, err := ring.current.seal(plain, "log")
+	if err != nil { return nil, err }
+
+	line := logRecordPrefix + ring.current.id + ":" + base64.StdEncoding.EncodeToString(sealed)
+	return []byte(line), nil
+}
+
+// openRecord also returns the id of the key the record was sealed with.
+func (ring *KeyRing) openRecord(line []byte) ([]byte, string, error) {
+	rest, ok := bytes.CutPrefix(line, []byte(logRecordPrefix))
+	if !ok {
+		if !ring.plainAllowed() { return nil, "", ErrNotEncrypted }
+		return line, "", nil
+	}
+
+	id, encoded, ok := bytes.Cut(rest, []byte(":"))
+	if !ok { return nil, "", errors.New("malformed encrypted log record") }
+
+	key, err := ring.key(string(id))
+	if err != nil { return nil, "", err }
+
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil { return nil, "", err }
+
+	plain, err := key.open(sealed, "log")
+	return plain, key.id, err
+}
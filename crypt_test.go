@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyRing(t *testing.T, migrating bool) *KeyRing {
+	t.Helper()
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil { t.Fatal(err) }
+
+	ring, err := NewKeyRing(base64.StdEncoding.EncodeToString(raw), nil, migrating)
+	if err != nil { t.Fatal(err) }
+	return ring
+}
+
+// TestPlainRecordsRejected checks a record appended to the log of an
+// encrypted database without being sealed stops it from opening.
+func TestPlainRecordsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	ring := testKeyRing(t, false)
+
+	db := openTestDB(t, path, DBOptions{ Keys: ring })
+	if _, err := db.CreateUser("a@b.c", "hash"); err != nil { t.Fatal(err) }
+	if err := db.Close(); err != nil { t.Fatal(err) }
+
+	injected := `{"entries":[{"op":"put","table":"users","key":"1","value":{"id":1,"email":"a@b.c","role":"admin"}}]}` + "\n"
+	f, err := os.OpenFile(path + walSuffix, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil { t.Fatal(err) }
+	if _, err := f.WriteString(injected); err != nil { t.Fatal(err) }
+	f.Close()
+
+	_, err = NewDBWithOptions(path, DBOptions{ Keys: ring })
+	if !errors.Is(err, ErrNotEncrypted) { t.Fatalf("opening with an injected record returned %v, want ErrNotEncrypted", err) }
+}
+
+// TestEncryptingExistingDB checks a plain database only opens with a key
+// when migrating, and is encrypted straight away when it does.
+func TestEncryptingExistingDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, DBOptions{})
+	if _, err := db.CreateUser("a@b.c", "hash"); err != nil { t.Fatal(err) }
+	if err := db.Close(); err != nil { t.Fatal(err) }
+
+	ring := testKeyRing(t, false)
+	_, err := NewDBWithOptions(path, DBOptions{ Keys: ring })
+	if !errors.Is(err, ErrNotEncrypted) { t.Fatalf("opening a plain database returned %v, want ErrNotEncrypted", err) }
+
+	ring.migrating = true
+	db = openTestDB(t, path, DBOptions{ Keys: ring })
+	if err := db.Close(); err != nil { t.Fatal(err) }
+
+	dat, err := os.ReadFile(path)
+	if err != nil { t.Fatal(err) }
+	if !bytes.HasPrefix(dat, []byte(snapshotMagic)) { t.Fatalf("snapshot wasn't encrypted: %.40s", dat) }
+
+	ring.migrating = false
+	db = openTestDB(t, path, DBOptions{ Keys: ring })
+	defer db.Close()
+	if _, err := db.GetUserFromEmail("a@b.c"); err != nil { t.Fatalf("user lost in migration: %s", err) }
+}
@@ -1,16 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"errors"
+	"io"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DB struct {
 	path string
+	opts DBOptions
 	mu *sync.RWMutex
+	// state is the decoded database, kept in memory and written through to
+	// the log on every Update
+	state DBStructure
+	indexes dbIndexes
+	log *os.File
+	logRecords int
+	// set by readState when some of what's on disk isn't encrypted the way
+	// it would be written now
+	stale bool
+	dirty atomic.Bool
+	stamps [2]fileStamp
+	done chan struct{}
+	closed bool
 }
 
 type Chirp struct {
@@ -24,35 +43,179 @@ type User struct {
 	Password string `json:"password"`
 	Email string `json:"email"`
 	IsChirpyRed bool `json:"is_chirpy_red"`
+	Role string `json:"role"`
+	// Verified is set once the user has shown they can read mail sent to
+	// Email, and cleared when Email changes
+	Verified bool `json:"verified"`
+	TOTP TOTP `json:"totp"`
+}
+
+// TOTP is a user's second factor. Secret is set when they start enrolling,
+// and it's only asked for at login once they've proven they can generate
+// codes with it.
+type TOTP struct {
+	Secret string `json:"secret"`
+	Enabled bool `json:"enabled"`
+	// LastStep is the time step of the last code accepted, so that a code
+	// can't be used twice
+	LastStep int64 `json:"last_step"`
+	// sha256 hashes of the recovery codes that haven't been used yet
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 type RefreshToken struct {
 	Revoked bool
 	Time time.Time
+	ExpiresAt time.Time
+	// Family is shared by every token rotated out of the same login
+	Family string
+	// Rotated is set once the token has been exchanged for a new one. It's
+	// kept until it expires so that replaying it can be noticed.
+	Rotated bool
+	UserId int
+	// CreatedAt is when the family's first token was issued, ie when the
+	// user logged in
+	CreatedAt time.Time
+	LastUsedAt time.Time
+	UserAgent string
+	IP string
+}
+
+// Session is a login as seen by its user, one per live token family.
+type Session struct {
+	Id string `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string `json:"user_agent"`
+	IP string `json:"ip"`
+}
+
+// APIKey is a key a user made for a script or bot to act as them. Only a
+// hash of the key itself is kept, as its key in the table.
+type APIKey struct {
+	Id string `json:"id"`
+	UserId int `json:"user_id"`
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// OneTimeToken is a token sent to a user by email to prove they can read
+// it, such as a password reset link. Like api keys only a hash of it is kept.
+type OneTimeToken struct {
+	Purpose string
+	UserId int
+	// the address it was sent to
+	Email string
+	ExpiresAt time.Time
+}
+
+// OAuthClient is a third party app registered by a user to act on behalf of
+// other users through /oauth. Public clients, like ones running in a
+// browser, have no secret and rely on PKCE alone.
+type OAuthClient struct {
+	Id string `json:"id"`
+	UserId int `json:"user_id"`
+	Name string `json:"name"`
+	SecretHash string `json:"secret_hash,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Identity links an account at an external OpenID Connect provider to a
+// user, so they can log in with it.
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject string `json:"subject"`
+	UserId int `json:"user_id"`
+	// the email the provider gave when it was linked
+	Email string `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// identityKey is how identities are keyed in the json table.
+func identityKey(provider, subject string) string {
+	return provider + " " + subject
+}
+
+func (t RefreshToken) live(now time.Time) bool {
+	return !t.Revoked && !t.Rotated && now.Before(t.ExpiresAt)
+}
+
+func (t RefreshToken) session() Session {
+	return Session{
+		Id: t.Family,
+		CreatedAt: t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+		ExpiresAt: t.ExpiresAt,
+		UserAgent: t.UserAgent,
+		IP: t.IP,
+	}
 }
 
 type DBStructure struct {
+	SchemaVersion int `json:"schema_version"`
 	Chirps map[int]Chirp
 	Users map[int]User
 	Tokens map[string]RefreshToken
+	APIKeys map[string]APIKey
+	OneTimeTokens map[string]OneTimeToken
+	OAuthClients map[string]OAuthClient
+	Identities map[string]Identity
+	// Sequences holds the last id handed out for each table, so ids are
+	// never reused after a delete
+	Sequences map[string]int
 }
 
 var ErrNotExist = errors.New("resource does not exist")
+var ErrEmailInUse = errors.New("email is already in use")
+var ErrCodeUsed = errors.New("code was already used")
 
 func NewDB(path string) (*DB, error) {
+	return NewDBWithOptions(path, DBOptions{})
+}
+
+func NewDBWithOptions(path string, opts DBOptions) (*DB, error) {
 	db := &DB{
 		path: path,
+		opts: opts,
 		mu: &sync.RWMutex{},
+		done: make(chan struct{}),
 	}
 
-	return db, db.ensureDB()
+	err := db.ensureDB()
+	if err != nil { return nil, err }
+
+	// fold whatever was logged last run into the snapshot, which also drops
+	// any half written record left at the end of the log
+	db.mu.Lock()
+	err = db.load()
+	if err == nil { err = db.compact() }
+	db.mu.Unlock()
+	if err != nil {
+		if db.log != nil { db.log.Close() }
+		return nil, err
+	}
+
+	if opts.SyncInterval > 0 {
+		go db.syncLoop(opts.SyncInterval)
+	}
+	return db, nil
 }
 
 func (db *DB) createDB() error {
 	dbs := DBStructure{
+		SchemaVersion: currentSchemaVersion,
 		Chirps: make(map[int]Chirp),
 		Users: make(map[int]User),
 		Tokens: make(map[string]RefreshToken),
+		APIKeys: make(map[string]APIKey),
+		OneTimeTokens: make(map[string]OneTimeToken),
+		OAuthClients: make(map[string]OAuthClient),
+		Identities: make(map[string]Identity),
+		Sequences: make(map[string]int),
 	}
 	return db.writeDB(dbs)
 }
@@ -66,137 +229,242 @@ func (db *DB) ensureDB() error {
 }
 
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	dbs, err := db.loadDB()
-	if err != nil { return User{}, err }
-
-	id := len(dbs.Users) + 1
-	
-	if _, err := hasEmail(dbs, email); err == nil {
-		return User{}, errors.New("email is already in user")
-	}
-
-	user := User{
-		Email: email,
-		Password: password,
-		Id: id,
-	}
-	dbs.Users[id] = user
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := db.indexes.emails[normalizeEmail(email)]; ok {
+			return ErrEmailInUse
+		}
 
-	err = db.writeDB(dbs)
+		id := tx.nextId(tableUsers)
+		user = User{
+			Email: email,
+			Password: password,
+			Id: id,
+			Role: RoleUser,
+		}
+		tx.putUser(id, user)
+		return nil
+	})
 	if err != nil { return User{}, err }
 
 	return user, nil
 }
 
+// UpdateUser changes a user's email and password, an empty one is left as
+// it is. Changing the email drops the one time tokens mailed to the old one.
 func (db *DB) UpdateUser(id int, email, password string) (User, error) {
-	dbs, err := db.loadDB()
-	if err != nil { return User{}, err }
-
-	user, ok := dbs.Users[id]
-	if !ok { return User{}, ErrNotExist }
-
-	user.Email = email
-	user.Password = password
-	dbs.Users[id] = user
-	
-	err = db.writeDB(dbs)
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		user, ok = tx.Users[id]
+		if !ok { return ErrNotExist }
+
+		if email != "" {
+			if other, ok := db.indexes.emails[normalizeEmail(email)]; ok && other != id {
+				return ErrEmailInUse
+			}
+			if normalizeEmail(user.Email) != normalizeEmail(email) {
+				user.Verified = false
+				for hash, oneTimeToken := range tx.OneTimeTokens {
+					if oneTimeToken.UserId == id { tx.deleteOneTimeToken(hash) }
+				}
+			}
+			user.Email = email
+		}
+		if password != "" { user.Password = password }
+		tx.putUser(id, user)
+		return nil
+	})
 	if err != nil { return User{}, err }
 
 	return user, nil
 }
 
 func (db *DB) UpgradeUser(id int) error {
-	dbs, err := db.loadDB()
-	if err != nil { return err }
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
+
+		user.IsChirpyRed = true
+		tx.putUser(id, user)
+		return nil
+	})
+}
 
-	user, ok := dbs.Users[id]
-	if !ok { return ErrNotExist }
+func (db *DB) VerifyUser(id int) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
 
-	user.IsChirpyRed = true
-	dbs.Users[id] = user
+		user.Verified = true
+		tx.putUser(id, user)
+		return nil
+	})
+}
 
-	return db.writeDB(dbs)
+func (db *DB) SetUserRole(id int, role string) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
+
+		user.Role = role
+		tx.putUser(id, user)
+		return nil
+	})
 }
 
-func (db *DB) RemoveUser(id int) error {
-	dbs, err := db.loadDB()
-	if err != nil { return err }
+func (db *DB) SetUserPassword(id int, password string) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
+
+		user.Password = password
+		tx.putUser(id, user)
+		return nil
+	})
+}
 
-	delete(dbs.Users, id)
+func (db *DB) SetUserTOTP(id int, totp TOTP) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
 
-	return db.writeDB(dbs)
+		user.TOTP = totp
+		tx.putUser(id, user)
+		return nil
+	})
 }
 
-func (db *DB) GetUserFromId(id int) (User, error) {
-	dbs, err := db.loadDB()
-	if err != nil { return User{}, err}
+// UseTOTPStep records that a code from step was accepted, returning
+// ErrCodeUsed if one from that step or a later one already was.
+func (db *DB) UseTOTPStep(id int, step int64) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
+		if step <= user.TOTP.LastStep { return ErrCodeUsed }
+
+		user.TOTP.LastStep = step
+		tx.putUser(id, user)
+		return nil
+	})
+}
 
-	user, ok := dbs.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
-	}
+// UseRecoveryCode removes a recovery code, returning ErrNotExist if the user
+// doesn't have it.
+func (db *DB) UseRecoveryCode(id int, hash string) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.Users[id]
+		if !ok { return ErrNotExist }
+
+		i := slices.Index(user.TOTP.RecoveryCodes, hash)
+		if i < 0 { return ErrNotExist }
+
+		user.TOTP.RecoveryCodes = slices.Delete(slices.Clone(user.TOTP.RecoveryCodes), i, i + 1)
+		tx.putUser(id, user)
+		return nil
+	})
+}
+
+func (db *DB) RemoveUser(id int) error {
+	return db.Update(func(tx *Tx) error {
+		tx.deleteUser(id)
+		return nil
+	})
+}
+
+func (db *DB) GetUserFromId(id int) (User, error) {
+	user := User{}
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		user, ok = dbs.Users[id]
+		if !ok { return ErrNotExist }
+		return nil
+	})
+	if err != nil { return User{}, err }
 
 	return user, nil
 }
 
 func (db *DB) GetUserFromEmail(email string) (User, error) {
-	dbs, err := db.loadDB()
+	user := User{}
+	err := db.View(func(dbs *DBStructure) error {
+		id, ok := db.indexes.emails[normalizeEmail(email)]
+		if !ok { return ErrNotExist }
+		user = dbs.Users[id]
+		return nil
+	})
 	if err != nil { return User{}, err }
 
-	return hasEmail(dbs, email)
+	return user, nil
 }
 
 func (db *DB) CreateChirp(author int, body string) (Chirp, error) {
-
-	dbs, err := db.loadDB()
-	if err != nil { return Chirp{}, err }
-
-	id := len(dbs.Chirps) + 1
-
-	chirp := Chirp{
-		AuthorId: author,
-		Body: body,
-		Id: id,
-	}
-	dbs.Chirps[id] = chirp
-
-	err = db.writeDB(dbs)
+	chirp := Chirp{}
+	err := db.Update(func(tx *Tx) error {
+		id := tx.nextId(tableChirps)
+		chirp = Chirp{
+			AuthorId: author,
+			Body: body,
+			Id: id,
+		}
+		tx.putChirp(id, chirp)
+		return nil
+	})
 	if err != nil { return Chirp{}, err }
 	
 	return chirp, nil
 }
 
 func (db *DB) GetChirp(id int) (Chirp, error) {
-	dbs, err := db.loadDB()
+	chirp := Chirp{}
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		chirp, ok = dbs.Chirps[id]
+		if !ok { return ErrNotExist }
+		return nil
+	})
 	if err != nil { return Chirp{}, err }
 
-	chirp, ok := dbs.Chirps[id]
-	if !ok {
-		return Chirp{}, ErrNotExist
-	}
-
 	return chirp, nil
 }
 
 func (db *DB) GetChirps() ([]Chirp, error) {
-	dbs, err := db.loadDB()
-	if err != nil { return nil, err }
+	var out []Chirp
+	err := db.View(func(dbs *DBStructure) error {
+		out = make([]Chirp, 0, len(dbs.Chirps))
 
-	out := make([]Chirp, len(dbs.Chirps))
+		for _, chirp := range dbs.Chirps {
+			out = append(out, chirp)
+		}
+		slices.SortFunc(out, func(a, b Chirp) int { return cmp.Compare(a.Id, b.Id) })
+		return nil
+	})
+	if err != nil { return nil, err }
 
-	for _, chirp := range dbs.Chirps {
-		out[chirp.Id - 1] = chirp
-	}
 	return out, nil
 }
 
-func (db *DB) DeleteChirp(id int) error {
-	dbs, err := db.loadDB()
-	if err != nil { return err }
+func (db *DB) GetChirpsByAuthor(author int) ([]Chirp, error) {
+	var out []Chirp
+	err := db.View(func(dbs *DBStructure) error {
+		ids := db.indexes.chirpsByAuthor[author]
+		out = make([]Chirp, 0, len(ids))
+
+		for _, id := range ids {
+			out = append(out, dbs.Chirps[id])
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
 
-	delete(dbs.Chirps, id)
+	return out, nil
+}
 
-	return db.writeDB(dbs)
+func (db *DB) DeleteChirp(id int) error {
+	return db.Update(func(tx *Tx) error {
+		tx.deleteChirp(id)
+		return nil
+	})
 }
 
 func (db *DB) IsChirpAuthor(author, id int) bool {
@@ -206,65 +474,463 @@ func (db *DB) IsChirpAuthor(author, id int) bool {
 	return chirp.AuthorId == author
 }
 
-func (db *DB) AddToken(token string) error {
-	dbs, err := db.loadDB()
+func (db *DB) AddToken(token string, refreshToken RefreshToken) error {
+	return db.Update(func(tx *Tx) error {
+		tx.putToken(token, refreshToken)
+		return nil
+	})
+}
+
+// RotateToken swaps oldToken for newToken in the same family, taking the
+// expiry and the details of who's using it from next. Presenting a token that
+// has already been rotated means someone else has a copy of it, so the whole
+// family is revoked and ErrTokenReused returned.
+func (db *DB) RotateToken(oldToken, newToken string, next RefreshToken) error {
+	var reused bool
+	err := db.Update(func(tx *Tx) error {
+		refreshToken, ok := tx.Tokens[oldToken]
+		if !ok { return ErrNotExist }
+
+		if refreshToken.Rotated && !refreshToken.Revoked {
+			reused = true
+			revokeFamily(tx, refreshToken.Family, time.Now())
+			return nil
+		}
+		if refreshToken.Revoked || !time.Now().Before(refreshToken.ExpiresAt) {
+			return ErrRevokedToken
+		}
+
+		refreshToken.Rotated = true
+		tx.putToken(oldToken, refreshToken)
+
+		next.Family = refreshToken.Family
+		next.CreatedAt = refreshToken.CreatedAt
+		if next.CreatedAt.IsZero() { next.CreatedAt = next.LastUsedAt }
+		tx.putToken(newToken, next)
+		return nil
+	})
 	if err != nil { return err }
+	if reused { return ErrTokenReused }
 
-	dbs.Tokens[token] = RefreshToken{ Revoked: false }
-	return db.writeDB(dbs)
+	return nil
 }
 
-func (db *DB) RevokeToken(token string) error {
-	dbs, err := db.loadDB()
-	if err != nil { return err }
+func revokeFamily(tx *Tx, family string, now time.Time) {
+	for token, refreshToken := range tx.Tokens {
+		if refreshToken.Family == family && !refreshToken.Revoked {
+			refreshToken.Revoked = true
+			refreshToken.Time = now
+			tx.putToken(token, refreshToken)
+		}
+	}
+}
 
-	dbs.Tokens[token] = RefreshToken{ Revoked: true, Time: time.Now()}
-	return db.writeDB(dbs)
+func (db *DB) RevokeToken(token string) error {
+	return db.Update(func(tx *Tx) error {
+		refreshToken, ok := tx.Tokens[token]
+		if !ok { return nil }
+
+		refreshToken.Revoked = true
+		refreshToken.Time = time.Now()
+		tx.putToken(token, refreshToken)
+		return nil
+	})
 }
 
+// ValidToken reports whether token was handed out by AddToken and hasn't
+// been revoked or expired since.
 func (db *DB) ValidToken(token string) bool {
-	dbs, err := db.loadDB()
-	if err != nil { return false }
+	valid := false
+	db.View(func(dbs *DBStructure) error {
+		refreshToken, ok := dbs.Tokens[token]
+		valid = ok && refreshToken.live(time.Now())
+		return nil
+	})
+	return valid
+}
+
+// GetSessions returns the user's live sessions, most recently used first.
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	out := []Session{}
+	err := db.View(func(dbs *DBStructure) error {
+		now := time.Now()
+		for _, refreshToken := range dbs.Tokens {
+			if refreshToken.UserId == userId && refreshToken.live(now) {
+				out = append(out, refreshToken.session())
+			}
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	sortSessions(out)
+	return out, nil
+}
+
+// RevokeSession revokes one of the user's sessions, returning ErrNotExist if
+// they have no live session with that id.
+func (db *DB) RevokeSession(userId int, id string) error {
+	return db.Update(func(tx *Tx) error {
+		now := time.Now()
+		for _, refreshToken := range tx.Tokens {
+			if refreshToken.Family == id && refreshToken.UserId == userId && refreshToken.live(now) {
+				revokeFamily(tx, id, now)
+				return nil
+			}
+		}
+		return ErrNotExist
+	})
+}
+
+// RevokeSessions revokes every session the user has and returns how many
+// were live.
+func (db *DB) RevokeSessions(userId int) (int, error) {
+	revoked := 0
+	err := db.Update(func(tx *Tx) error {
+		now := time.Now()
+		for token, refreshToken := range tx.Tokens {
+			if refreshToken.UserId != userId || refreshToken.Revoked { continue }
+
+			if refreshToken.live(now) { revoked++ }
+			refreshToken.Revoked = true
+			refreshToken.Time = now
+			tx.putToken(token, refreshToken)
+		}
+		return nil
+	})
+	if err != nil { return 0, err }
+
+	return revoked, nil
+}
+
+func sortSessions(sessions []Session) {
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return b.LastUsedAt.Compare(a.LastUsedAt)
+	})
+}
+
+func (db *DB) CreateAPIKey(hash string, key APIKey) error {
+	return db.Update(func(tx *Tx) error {
+		tx.putAPIKey(hash, key)
+		return nil
+	})
+}
+
+func (db *DB) GetAPIKey(hash string) (APIKey, error) {
+	key := APIKey{}
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		key, ok = dbs.APIKeys[hash]
+		if !ok { return ErrNotExist }
+		return nil
+	})
+	if err != nil { return APIKey{}, err }
+
+	return key, nil
+}
+
+// GetAPIKeys returns the user's api keys, newest first.
+func (db *DB) GetAPIKeys(userId int) ([]APIKey, error) {
+	out := []APIKey{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, key := range dbs.APIKeys {
+			if key.UserId == userId { out = append(out, key) }
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	sortAPIKeys(out)
+	return out, nil
+}
+
+func (db *DB) DeleteAPIKey(userId int, id string) error {
+	return db.Update(func(tx *Tx) error {
+		for hash, key := range tx.APIKeys {
+			if key.Id == id && key.UserId == userId {
+				tx.deleteAPIKey(hash)
+				return nil
+			}
+		}
+		return ErrNotExist
+	})
+}
+
+func sortAPIKeys(keys []APIKey) {
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+}
+
+func (db *DB) CreateOAuthClient(client OAuthClient) error {
+	return db.Update(func(tx *Tx) error {
+		tx.putOAuthClient(client.Id, client)
+		return nil
+	})
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	client := OAuthClient{}
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		client, ok = dbs.OAuthClients[id]
+		if !ok { return ErrNotExist }
+		return nil
+	})
+	if err != nil { return OAuthClient{}, err }
+
+	return client, nil
+}
+
+// GetOAuthClients returns the clients the user registered, newest first.
+func (db *DB) GetOAuthClients(userId int) ([]OAuthClient, error) {
+	out := []OAuthClient{}
+	err := db.View(func(dbs *DBStructure) error {
+		for _, client := range dbs.OAuthClients {
+			if client.UserId == userId { out = append(out, client) }
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	slices.SortFunc(out, func(a, b OAuthClient) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return out, nil
+}
+
+func (db *DB) DeleteOAuthClient(userId int, id string) error {
+	return db.Update(func(tx *Tx) error {
+		client, ok := tx.OAuthClients[id]
+		if !ok || client.UserId != userId { return ErrNotExist }
+
+		tx.deleteOAuthClient(id)
+		return nil
+	})
+}
+
+func (db *DB) CreateIdentity(identity Identity) error {
+	return db.Update(func(tx *Tx) error {
+		tx.putIdentity(identityKey(identity.Provider, identity.Subject), identity)
+		return nil
+	})
+}
 
-	refreshToken, ok := dbs.Tokens[token]
-	if !ok {
-		return true
+func (db *DB) GetIdentity(provider, subject string) (Identity, error) {
+	identity := Identity{}
+	err := db.View(func(dbs *DBStructure) error {
+		var ok bool
+		identity, ok = dbs.Identities[identityKey(provider, subject)]
+		if !ok { return ErrNotExist }
+		return nil
+	})
+	if err != nil { return Identity{}, err }
+
+	return identity, nil
+}
+
+// CreateOneTimeToken stores a new token, dropping any the user already had
+// for the same purpose so only the latest one sent works.
+func (db *DB) CreateOneTimeToken(hash string, token OneTimeToken) error {
+	return db.Update(func(tx *Tx) error {
+		for other, oneTimeToken := range tx.OneTimeTokens {
+			if oneTimeToken.UserId == token.UserId && oneTimeToken.Purpose == token.Purpose {
+				tx.deleteOneTimeToken(other)
+			}
+		}
+		tx.putOneTimeToken(hash, token)
+		return nil
+	})
+}
+
+// ConsumeOneTimeToken deletes a token and returns it, or returns ErrNotExist
+// if there's no such token for purpose or it has expired.
+func (db *DB) ConsumeOneTimeToken(hash, purpose string, now time.Time) (OneTimeToken, error) {
+	token := OneTimeToken{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		token, ok = tx.OneTimeTokens[hash]
+		if !ok || token.Purpose != purpose { return ErrNotExist }
+
+		tx.deleteOneTimeToken(hash)
+		if !now.Before(token.ExpiresAt) { return ErrNotExist }
+		return nil
+	})
+	if err != nil { return OneTimeToken{}, err }
+
+	return token, nil
+}
+
+// PurgeTokens deletes every token that's expired or revoked as of now and
+// returns how many went. Neither kind can pass ValidToken again, so there's
+// no reason to keep them. Rotated tokens stay until they expire. Expired one
+// time tokens go too.
+func (db *DB) PurgeTokens(now time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for token, refreshToken := range tx.Tokens {
+			if refreshToken.Revoked || !now.Before(refreshToken.ExpiresAt) {
+				tx.deleteToken(token)
+				purged++
+			}
+		}
+		for hash, oneTimeToken := range tx.OneTimeTokens {
+			if !now.Before(oneTimeToken.ExpiresAt) {
+				tx.deleteOneTimeToken(hash)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil { return 0, err }
+
+	return purged, nil
+}
+
+// Update runs fn in a transaction while holding the write lock, so no other
+// transaction can interleave with it, then logs whatever fn changed. If fn
+// returns an error nothing is written and its changes are undone.
+func (db *DB) Update(fn func(*Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.opts.WatchFile && db.changedOnDisk() {
+		if err := db.load(); err != nil { return err }
+	}
+
+	tx := &Tx{ DBStructure: &db.state }
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if len(tx.entries) == 0 { return nil }
+
+	err = db.writeLog(tx.entries...)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	for _, reindex := range tx.reindex {
+		reindex(&db.indexes)
 	}
-	if refreshToken.Revoked {
-		return false
+	if db.logRecords >= compactThreshold {
+		return db.compact()
 	}
-	return true
+	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
+// View runs fn on the current state while holding the read lock. fn must
+// not modify the state.
+func (db *DB) View(fn func(*DBStructure) error) error {
+	if db.opts.WatchFile {
+		if err := db.reloadIfChanged(); err != nil { return err }
+	}
+
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	dat, err := os.ReadFile(db.path)
-	if err != nil { return DBStructure{}, err }
+	return fn(&db.state)
+}
+
+// readState reads the snapshot and replays the log on top of it, returning
+// the state and the number of log records replayed. Callers must hold db.mu.
+//
+// Another process can compact while this reads. The log is read before the
+// snapshot, because compacting replaces the snapshot and only then empties
+// the log, so seeing the old log with the old snapshot or the new snapshot
+// are both fine: replaying entries a snapshot already has changes nothing.
+// What isn't fine is a compaction slipping in between the two reads after
+// more was logged, since replaying the old log would then undo the newer
+// changes in the new snapshot. So the snapshot has to be the same file
+// before and after the log is read, otherwise it all gets read again.
+func (db *DB) readState() (DBStructure, int, error) {
+	var logDat, dat []byte
+	var err error
+	stable := false
+	for attempt := 0; !stable; attempt++ {
+		if attempt == readStateAttempts {
+			return DBStructure{}, 0, errors.New("database kept being compacted while reading it")
+		}
+		logDat, dat, stable, err = db.readFiles()
+		if err != nil { return DBStructure{}, 0, err }
+	}
+
+	dat, keyId, err := db.opts.Keys.openSnapshot(dat)
+	if err != nil { return DBStructure{}, 0, err }
+	db.stale = !db.opts.Keys.fresh(keyId)
 	
 	dbs := DBStructure{}
 
 	err = json.Unmarshal(dat, &dbs)
-	if err != nil { return DBStructure{}, err }
-	return dbs, nil	
+	if err != nil { return DBStructure{}, 0, err }
+	dbs.ensureTables()
+
+	n, err := db.replayLog(&dbs, bytes.NewReader(logDat))
+	if err != nil { return DBStructure{}, 0, err }
+
+	return dbs, n, nil	
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+const readStateAttempts = 5
+
+// readFiles reads the log and then the snapshot, reporting whether the
+// snapshot stayed the same file the whole time.
+func (db *DB) readFiles() ([]byte, []byte, bool, error) {
+	before, err := os.Stat(db.path)
+	if err != nil { return nil, nil, false, err }
+
+	logDat, err := os.ReadFile(db.logPath())
+	if err != nil && !os.IsNotExist(err) { return nil, nil, false, err }
+
+	f, err := os.Open(db.path)
+	if err != nil { return nil, nil, false, err }
+	defer f.Close()
 
+	after, err := f.Stat()
+	if err != nil { return nil, nil, false, err }
+	dat, err := io.ReadAll(f)
+	if err != nil { return nil, nil, false, err }
+
+	stable := os.SameFile(before, after) && before.ModTime().Equal(after.ModTime()) &&
+		before.Size() == after.Size()
+	return logDat, dat, stable, nil
+}
+
+// writeDB atomically replaces the snapshot file. Callers must hold db.mu
+// for writing.
+func (db *DB) writeDB(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 	if err != nil { return err }
 
-	return os.WriteFile(db.path, dat, 0600)
-}
+	dat, err = db.opts.Keys.sealSnapshot(dat)
+	if err != nil { return err }
 
-func hasEmail(dbs DBStructure, email string) (User, error) {
-	for _, user := range dbs.Users {
-		if user.Email == email {
-			return user, nil
-		}
+	tmp := db.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil { return err }
+
+	_, err = f.Write(dat)
+	if err == nil { err = f.Sync() }
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil {
+		os.Remove(tmp)
+		return err
 	}
-	return User{}, ErrNotExist
+
+	return os.Rename(tmp, db.path)
+}
+
+// ensureTables makes sure every table exists, so files written before a
+// table was added can still be replayed into.
+func (dbs *DBStructure) ensureTables() {
+	if dbs.Chirps == nil { dbs.Chirps = make(map[int]Chirp) }
+	if dbs.Users == nil { dbs.Users = make(map[int]User) }
+	if dbs.Tokens == nil { dbs.Tokens = make(map[string]RefreshToken) }
+	if dbs.APIKeys == nil { dbs.APIKeys = make(map[string]APIKey) }
+	if dbs.OneTimeTokens == nil { dbs.OneTimeTokens = make(map[string]OneTimeToken) }
+	if dbs.OAuthClients == nil { dbs.OAuthClients = make(map[string]OAuthClient) }
+	if dbs.Identities == nil { dbs.Identities = make(map[string]Identity) }
+	if dbs.Sequences == nil { dbs.Sequences = make(map[string]int) }
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, path string, opts DBOptions) *DB {
+	t.Helper()
+	db, err := NewDBWithOptions(path, opts)
+	if err != nil { t.Fatalf("opening %s: %s", path, err) }
+	return db
+}
+
+// TestConcurrentWrites has many goroutines create chirps at once, enough to
+// compact the log a couple of times along the way, then checks nothing was
+// lost once the files are read back.
+func TestConcurrentWrites(t *testing.T) {
+	const writers = 20
+	const perWriter = 60
+
+	for name, opts := range map[string]DBOptions{
+		"sync every write": {},
+		"batched sync": { SyncInterval: 5 * time.Millisecond },
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db := openTestDB(t, path, opts)
+
+			errs := make(chan error, writers * perWriter)
+			wg := sync.WaitGroup{}
+			for w := 1; w <= writers; w++ {
+				wg.Add(1)
+				go func(author int) {
+					defer wg.Done()
+					for i := 0; i < perWriter; i++ {
+						_, err := db.CreateChirp(author, fmt.Sprintf("chirp %d from %d", i, author))
+						if err != nil { errs <- err }
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatalf("creating chirp: %s", err)
+			}
+			if err := db.Close(); err != nil { t.Fatalf("closing: %s", err) }
+
+			db = openTestDB(t, path, opts)
+			defer db.Close()
+
+			chirps, err := db.GetChirps()
+			if err != nil { t.Fatalf("getting chirps: %s", err) }
+			if len(chirps) != writers * perWriter {
+				t.Fatalf("got %d chirps after reopening, want %d", len(chirps), writers * perWriter)
+			}
+			for i, chirp := range chirps {
+				if chirp.Id != i + 1 { t.Fatalf("chirp %d has id %d, ids should run 1 to %d", i, chirp.Id, len(chirps)) }
+			}
+			for author := 1; author <= writers; author++ {
+				byAuthor, err := db.GetChirpsByAuthor(author)
+				if err != nil { t.Fatalf("getting chirps by %d: %s", author, err) }
+				if len(byAuthor) != perWriter {
+					t.Errorf("author %d has %d chirps, want %d", author, len(byAuthor), perWriter)
+				}
+			}
+		})
+	}
+}
+
+// TestFailedUpdateChangesNothing checks a transaction that errors leaves
+// the state, the indexes and the log as they were.
+func TestFailedUpdateChangesNothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path, DBOptions{})
+	defer db.Close()
+
+	user, err := db.CreateUser("a@b.c", "hash")
+	if err != nil { t.Fatalf("creating user: %s", err) }
+
+	err = db.Update(func(tx *Tx) error {
+		user.Email = "changed@b.c"
+		tx.putUser(user.Id, user)
+		tx.nextId(tableUsers)
+		tx.deleteUser(user.Id)
+		return ErrNotExist
+	})
+	if err != ErrNotExist { t.Fatalf("Update returned %v, want ErrNotExist", err) }
+
+	got, err := db.GetUserFromEmail("a@b.c")
+	if err != nil || got.Id != user.Id { t.Fatalf("user wasn't restored: %+v, %v", got, err) }
+	if _, err := db.GetUserFromEmail("changed@b.c"); err != ErrNotExist {
+		t.Fatalf("email index kept the rolled back address")
+	}
+	if db.logRecords != 1 { t.Fatalf("log has %d records, want just the create", db.logRecords) }
+
+	next, err := db.CreateUser("d@b.c", "hash")
+	if err != nil { t.Fatalf("creating user: %s", err) }
+	if next.Id != user.Id + 1 { t.Fatalf("new user got id %d, the rolled back id should be reused", next.Id) }
+}
+
+// TestBatchedSyncWithReloads has two DBs share the files, so each one keeps
+// reloading, and replacing its log, while its sync loop is running.
+func TestBatchedSyncWithReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	opts := DBOptions{ SyncInterval: time.Millisecond, WatchFile: true }
+	a := openTestDB(t, path, opts)
+	b := openTestDB(t, path, opts)
+
+	const rounds = 300
+	for i := 0; i < rounds; i++ {
+		for _, db := range []*DB{ a, b } {
+			if _, err := db.CreateChirp(1, "hi"); err != nil { t.Fatalf("creating chirp: %s", err) }
+		}
+	}
+
+	for _, db := range []*DB{ a, b } {
+		if err := db.Close(); err != nil { t.Fatalf("closing: %s", err) }
+		if err := db.Close(); err != nil { t.Fatalf("closing again: %s", err) }
+	}
+
+	db := openTestDB(t, path, DBOptions{})
+	defer db.Close()
+	chirps, err := db.GetChirps()
+	if err != nil { t.Fatalf("getting chirps: %s", err) }
+	if len(chirps) != 2 * rounds { t.Fatalf("got %d chirps, want %d", len(chirps), 2 * rounds) }
+}
+
+// TestSchemaVersionSurvivesWrites opens a database from before versioning,
+// writes to it and reopens it, which has to leave it at the current version
+// without migrating again and clobbering the backup of the original.
+func TestSchemaVersionSurvivesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	original := []byte(`{"chirps":{"1":{"author_id":1,"body":"old","id":1}},"users":{}}`)
+	if err := os.WriteFile(path, original, 0600); err != nil { t.Fatal(err) }
+
+	db := openTestDB(t, path, DBOptions{})
+	for i := 0; i < compactThreshold + 1; i++ {
+		if _, err := db.CreateChirp(1, "new"); err != nil { t.Fatalf("creating chirp: %s", err) }
+	}
+	if err := db.Close(); err != nil { t.Fatalf("closing: %s", err) }
+
+	db = openTestDB(t, path, DBOptions{})
+	defer db.Close()
+
+	dat, err := os.ReadFile(path)
+	if err != nil { t.Fatal(err) }
+	snapshot := struct{ SchemaVersion int `json:"schema_version"` }{}
+	if err := json.Unmarshal(dat, &snapshot); err != nil { t.Fatal(err) }
+	if snapshot.SchemaVersion != currentSchemaVersion {
+		t.Fatalf("snapshot is at version %d, want %d", snapshot.SchemaVersion, currentSchemaVersion)
+	}
+
+	backup, err := os.ReadFile(path + ".v0.bak")
+	if err != nil { t.Fatalf("reading backup: %s", err) }
+	if string(backup) != string(original) { t.Fatalf("backup was overwritten with %.80s...", backup) }
+}
+
+// TestEmailChangeDropsOneTimeTokens checks links mailed to the old address
+// stop working when the email changes, in both stores.
+func TestEmailChangeDropsOneTimeTokens(t *testing.T) {
+	for _, driver := range []string{ DriverJSON, DriverSQLite } {
+		t.Run(driver, func(t *testing.T) {
+			db, err := OpenStore(driver, filepath.Join(t.TempDir(), "database"), DBOptions{})
+			if err != nil { t.Fatal(err) }
+			defer db.Close()
+
+			user, err := db.CreateUser("old@b.c", "hash")
+			if err != nil { t.Fatal(err) }
+			for _, hash := range []string{ "kept", "dropped" } {
+				err = db.CreateOneTimeToken(hash, OneTimeToken{
+					Purpose: purposePasswordReset, UserId: user.Id, Email: user.Email, ExpiresAt: time.Now().Add(time.Hour),
+				})
+				if err != nil { t.Fatal(err) }
+
+				// only a different address counts, not the same one cased differently
+				email := "OLD@b.c"
+				if hash == "dropped" { email = "new@b.c" }
+				if _, err := db.UpdateUser(user.Id, email, ""); err != nil { t.Fatal(err) }
+
+				_, err = db.ConsumeOneTimeToken(hash, purposePasswordReset, time.Now())
+				if hash == "kept" && err != nil { t.Fatalf("token was dropped for a change of case: %v", err) }
+				if hash == "dropped" && err != ErrNotExist { t.Fatalf("token for the old address returned %v, want ErrNotExist", err) }
+			}
+		})
+	}
+}
+
+// TestMigratedFamiliesDontLeakTokens checks sessions from before refresh
+// token families aren't listed under their token, whether they were migrated
+// by the first version of the migration or the current one.
+func TestMigratedFamiliesDontLeakTokens(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for name, version := range map[string]int{ "unmigrated": 2, "migrated by the old version": 5 } {
+		t.Run("json " + name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			family := `"Family":"old-token",`
+			if version < 3 { family = "" }
+			dat := fmt.Sprintf(`{"schema_version":%d,"Chirps":{},"Users":{},"Tokens":{"old-token":{%s"ExpiresAt":%q,"UserId":1}}}`,
+				version, family, expires)
+			if err := os.WriteFile(path, []byte(dat), 0600); err != nil { t.Fatal(err) }
+
+			db := openTestDB(t, path, DBOptions{})
+			defer db.Close()
+			checkSessionsDontLeak(t, db, "old-token")
+		})
+	}
+
+	t.Run("sqlite migrated by the old version", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "database.db")
+		db, err := NewSQLiteDB(path)
+		if err != nil { t.Fatal(err) }
+		err = db.AddToken("old-token", RefreshToken{ Family: "old-token", UserId: 1, ExpiresAt: time.Now().Add(time.Hour) })
+		if err != nil { t.Fatal(err) }
+		// back to just before the migration that fixes the families
+		version := slices.IndexFunc(sqliteMigrations, func(m string) bool { return strings.Contains(m, "WHERE family = token") })
+		_, err = db.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+		if err != nil { t.Fatal(err) }
+		db.Close()
+
+		db, err = NewSQLiteDB(path)
+		if err != nil { t.Fatal(err) }
+		defer db.Close()
+		checkSessionsDontLeak(t, db, "old-token")
+	})
+}
+
+func checkSessionsDontLeak(t *testing.T, db Store, token string) {
+	t.Helper()
+	sessions, err := db.GetSessions(1)
+	if err != nil { t.Fatal(err) }
+	if len(sessions) != 1 { t.Fatalf("got %d sessions, want 1", len(sessions)) }
+	if sessions[0].Id == token || sessions[0].Id == "" { t.Fatalf("session is listed as %q", sessions[0].Id) }
+}
+
+// TestEmailsMatchTheSameInBothStores checks emails differing only in case or
+// surrounding space are the same account whichever store is used.
+func TestEmailsMatchTheSameInBothStores(t *testing.T) {
+	for _, driver := range []string{ DriverJSON, DriverSQLite } {
+		t.Run(driver, func(t *testing.T) {
+			db, err := OpenStore(driver, filepath.Join(t.TempDir(), "database"), DBOptions{})
+			if err != nil { t.Fatal(err) }
+			defer db.Close()
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil { t.Fatal(err) }
+			if _, err := db.CreateUser(" A@B.com ", "hash"); err != ErrEmailInUse {
+				t.Fatalf("creating a duplicate returned %v, want ErrEmailInUse", err)
+			}
+			found, err := db.GetUserFromEmail(" A@b.COM")
+			if err != nil || found.Id != user.Id { t.Fatalf("looking up a differently written email returned %+v, %v", found, err) }
+
+			other, err := db.CreateUser("c@d.com", "hash")
+			if err != nil { t.Fatal(err) }
+			if _, err := db.UpdateUser(other.Id, "a@b.com ", ""); err != ErrEmailInUse {
+				t.Fatalf("changing to a duplicate returned %v, want ErrEmailInUse", err)
+			}
+		})
+	}
+}
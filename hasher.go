@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored in an encoded form that says which algorithm and
+// settings made them: bcrypt's own $2a$<cost>$ format, or the PHC format
+// for argon2id. New hashes are made with the configured PasswordHasher but
+// any supported format can be verified, and a hash that isn't what the
+// hasher would make now is replaced the next time its user logs in.
+
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt = "bcrypt"
+)
+
+const defaultBcryptCost = 12
+
+// argon2id defaults are the OWASP recommended minimum, 19 MiB and 2 passes
+const (
+	defaultArgon2Memory = 19 * 1024
+	defaultArgon2Time = 2
+	defaultArgon2Threads = 1
+	argon2SaltLength = 16
+	argon2KeyLength = 32
+)
+
+var ErrUnknownHash = errors.New("password hash is in an unknown format")
+
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Current reports whether encoded is what Hash would make now, apart
+	// from the salt.
+	Current(encoded string) bool
+}
+
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) (*BcryptHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost has to be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return &BcryptHasher{ cost: cost }, nil
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (h *BcryptHasher) Current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == h.cost
+}
+
+type Argon2Hasher struct {
+	// in KiB
+	memory uint32
+	time uint32
+	threads uint8
+}
+
+func NewArgon2Hasher(memory, time uint32, threads uint8) (*Argon2Hasher, error) {
+	if memory < 8 * uint32(threads) || time < 1 || threads < 1 {
+		return nil, errors.New("argon2id needs at least 1 pass and thread and 8 KiB of memory per thread")
+	}
+	return &Argon2Hasher{ memory: memory, time: time, threads: threads }, nil
+}
+
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil { return "", err }
+
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, argon2KeyLength)
+	return encodeArgon2id(argon2Params{ h.memory, h.time, h.threads }, salt, key), nil
+}
+
+func (h *Argon2Hasher) Current(encoded string) bool {
+	params, _, key, err := decodeArgon2id(encoded)
+	return err == nil && params == argon2Params{ h.memory, h.time, h.threads } &&
+		len(key) == argon2KeyLength
+}
+
+type argon2Params struct {
+	memory uint32
+	time uint32
+	threads uint8
+}
+
+// encodeArgon2id writes a hash as $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+func encodeArgon2id(params argon2Params, salt, key []byte) string {
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.memory, params.time, params.threads, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func decodeArgon2id(encoded string) (argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id { return argon2Params{}, nil, nil, ErrUnknownHash }
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version { return argon2Params{}, nil, nil, ErrUnknownHash }
+
+	params := argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil { return argon2Params{}, nil, nil, ErrUnknownHash }
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil { return argon2Params{}, nil, nil, ErrUnknownHash }
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 { return argon2Params{}, nil, nil, ErrUnknownHash }
+
+	return params, salt, key, nil
+}
+
+// verifyPassword checks password against a hash in any supported format.
+func verifyPassword(encoded, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$" + HashArgon2id + "$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil { return false, err }
+
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case strings.HasPrefix(encoded, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) { return false, nil }
+		return err == nil, err
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// passwordHasherFromEnv reads PASSWORD_HASH, argon2id by default or bcrypt,
+// and the settings for it: BCRYPT_COST, or ARGON2_MEMORY in KiB,
+// ARGON2_TIME and ARGON2_THREADS.
+func passwordHasherFromEnv() (PasswordHasher, error) {
+	switch alg := os.Getenv("PASSWORD_HASH"); alg {
+	case "", HashArgon2id:
+		memory, err := uintFromEnv("ARGON2_MEMORY", defaultArgon2Memory, 32)
+		if err != nil { return nil, err }
+		time, err := uintFromEnv("ARGON2_TIME", defaultArgon2Time, 32)
+		if err != nil { return nil, err }
+		threads, err := uintFromEnv("ARGON2_THREADS", defaultArgon2Threads, 8)
+		if err != nil { return nil, err }
+		return NewArgon2Hasher(uint32(memory), uint32(time), uint8(threads))
+	case HashBcrypt:
+		cost, err := uintFromEnv("BCRYPT_COST", defaultBcryptCost, 8)
+		if err != nil { return nil, err }
+		return NewBcryptHasher(int(cost))
+	default:
+		return nil, fmt.Errorf("PASSWORD_HASH: unknown algorithm %q", alg)
+	}
+}
+
+func uintFromEnv(name string, def uint64, bits int) (uint64, error) {
+	str := os.Getenv(name)
+	if str == "" { return def, nil }
+
+	n, err := strconv.ParseUint(str, 10, bits)
+	if err != nil { return 0, fmt.Errorf("%s: %w", name, err) }
+	return n, nil
+}
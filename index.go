@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// dbIndexes are lookups derived from the state. They aren't persisted, they
+// get rebuilt whenever the state is loaded and kept up to date as
+// transactions commit.
+type dbIndexes struct {
+	// lower cased email to user id
+	emails map[string]int
+	// author id to the ids of their chirps in ascending order
+	chirpsByAuthor map[int][]int
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func buildIndexes(dbs DBStructure) dbIndexes {
+	idx := dbIndexes{
+		emails: make(map[string]int, len(dbs.Users)),
+		chirpsByAuthor: make(map[int][]int),
+	}
+
+	for id, user := range dbs.Users {
+		email := normalizeEmail(user.Email)
+		// if two accounts only differ by case the older one keeps the address
+		if other, ok := idx.emails[email]; ok && other < id { continue }
+		idx.emails[email] = id
+	}
+	for id, chirp := range dbs.Chirps {
+		idx.chirpsByAuthor[chirp.AuthorId] = append(idx.chirpsByAuthor[chirp.AuthorId], id)
+	}
+	for _, ids := range idx.chirpsByAuthor {
+		slices.Sort(ids)
+	}
+	return idx
+}
+
+func (idx *dbIndexes) addUser(id int, user User) {
+	idx.emails[normalizeEmail(user.Email)] = id
+}
+
+func (idx *dbIndexes) removeUser(id int, user User) {
+	email := normalizeEmail(user.Email)
+	if idx.emails[email] == id { delete(idx.emails, email) }
+}
+
+func (idx *dbIndexes) addChirp(author, id int) {
+	ids := idx.chirpsByAuthor[author]
+	i, found := slices.BinarySearch(ids, id)
+	if found { return }
+	idx.chirpsByAuthor[author] = slices.Insert(ids, i, id)
+}
+
+func (idx *dbIndexes) removeChirp(author, id int) {
+	ids := idx.chirpsByAuthor[author]
+	i, found := slices.BinarySearch(ids, id)
+	if !found { return }
+
+	ids = slices.Delete(ids, i, i + 1)
+	if len(ids) == 0 {
+		delete(idx.chirpsByAuthor, author)
+		return
+	}
+	idx.chirpsByAuthor[author] = ids
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens are signed with the newest key in a KeySet and carry its id in the
+// kid header. When a key is rotated out it's kept for verification until
+// every token it could have signed has expired, and the public halves of all
+// kept keys are published as a JWKS so other services can check our tokens
+// without holding any secret. OpenID Connect only requires relying parties to
+// handle RS256, so there's always a current RS256 key for id tokens as well,
+// whatever JWT_ALG our own tokens use.
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+const defaultKeyRotation = 30 * 24 * time.Hour
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+type signingKey struct {
+	Id string `json:"kid"`
+	Alg string `json:"alg"`
+	CreatedAt time.Time `json:"created_at"`
+	RetiredAt time.Time `json:"retired_at,omitempty"`
+	// PKCS #8 DER, base64 encoded in the file
+	Private []byte `json:"private_key"`
+
+	signer crypto.Signer
+}
+
+type KeySet struct {
+	path string
+	alg string
+	rotation time.Duration
+	// how long a retired key is kept, which has to cover the longest lived
+	// token it could have signed
+	retention time.Duration
+	mu *sync.RWMutex
+	// newest first, the newest unretired key of each algorithm signs
+	keys []*signingKey
+}
+
+// LoadKeySet reads the key set at path, creating it with a fresh key if it
+// doesn't exist yet, and rotates it if the current key is due.
+func LoadKeySet(path, alg string, rotation time.Duration) (*KeySet, error) {
+	if alg != AlgEdDSA && alg != AlgRS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	ks := &KeySet{
+		path: path,
+		alg: alg,
+		rotation: rotation,
+		retention: refreshTokenLifetime,
+		mu: &sync.RWMutex{},
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) { return nil, err }
+	if err == nil {
+		file := struct{ Keys []*signingKey `json:"keys"` }{}
+		if err := json.Unmarshal(dat, &file); err != nil { return nil, err }
+
+		for _, key := range file.Keys {
+			parsed, err := x509.ParsePKCS8PrivateKey(key.Private)
+			if err != nil { return nil, fmt.Errorf("key %s: %w", key.Id, err) }
+
+			signer, ok := parsed.(crypto.Signer)
+			if !ok { return nil, fmt.Errorf("key %s can't sign", key.Id) }
+			key.signer = signer
+		}
+		ks.keys = file.Keys
+	}
+
+	return ks, ks.Rotate(false)
+}
+
+// algs are the algorithms a current key is kept for.
+func (ks *KeySet) algs() []string {
+	if ks.alg == AlgRS256 { return []string{ AlgRS256 } }
+	return []string{ ks.alg, AlgRS256 }
+}
+
+// current returns the key that signs with alg, or nil if there isn't one.
+// Callers must hold ks.mu.
+func (ks *KeySet) current(alg string) *signingKey {
+	for _, key := range ks.keys {
+		if key.Alg == alg && key.RetiredAt.IsZero() { return key }
+	}
+	return nil
+}
+
+// Rotate makes a new signing key for each algorithm if forced, if there
+// isn't one or if the current one is older than the rotation period, retires
+// keys for algorithms that aren't used any more and drops retired keys that
+// nothing can still be signed with.
+func (ks *KeySet) Rotate(force bool) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now().UTC()
+	changed := false
+
+	for _, alg := range ks.algs() {
+		current := ks.current(alg)
+		due := current == nil || (ks.rotation > 0 && now.Sub(current.CreatedAt) >= ks.rotation)
+		if !force && !due { continue }
+
+		key, err := newSigningKey(alg, now)
+		if err != nil { return err }
+
+		if current != nil { current.RetiredAt = now }
+		ks.keys = append([]*signingKey{ key }, ks.keys...)
+		changed = true
+		log.Printf("Rotated %s JWT signing key, now signing with %s", alg, key.Id)
+	}
+
+	kept := []*signingKey{}
+	for _, key := range ks.keys {
+		if key.RetiredAt.IsZero() && !slices.Contains(ks.algs(), key.Alg) {
+			key.RetiredAt = now
+			changed = true
+		}
+		if key.RetiredAt.IsZero() || now.Sub(key.RetiredAt) < ks.retention {
+			kept = append(kept, key)
+		} else {
+			changed = true
+		}
+	}
+	ks.keys = kept
+
+	if !changed { return nil }
+	return ks.save()
+}
+
+// save writes the key set out. Callers must hold ks.mu.
+func (ks *KeySet) save() error {
+	dat, err := json.Marshal(struct{ Keys []*signingKey `json:"keys"` }{ ks.keys })
+	if err != nil { return err }
+
+	tmp := ks.path + ".tmp"
+	err = os.WriteFile(tmp, dat, 0600)
+	if err != nil { return err }
+
+	return os.Rename(tmp, ks.path)
+}
+
+// Run checks whether the key is due for rotation every interval until done
+// is closed.
+func (ks *KeySet) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ks.Rotate(false); err != nil {
+				log.Printf("Error rotating JWT signing key: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func newSigningKey(alg string, now time.Time) (*signingKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil { return nil, err }
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil { return nil, err }
+
+	return &signingKey{
+		Id: randomToken(8),
+		Alg: alg,
+		CreatedAt: now,
+		Private: der,
+		signer: signer,
+	}, nil
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == AlgRS256 { return jwt.SigningMethodRS256 }
+	return jwt.SigningMethodEdDSA
+}
+
+// SignedString signs token with the current key, replacing whatever method
+// it was created with.
+func (ks *KeySet) SignedString(token *jwt.Token) (string, error) {
+	return ks.SignedStringWith(token, ks.alg)
+}
+
+// SignedStringWith signs token with the current key for alg, which has to
+// be one of the algorithms the set keeps keys for.
+func (ks *KeySet) SignedStringWith(token *jwt.Token, alg string) (string, error) {
+	ks.mu.RLock()
+	key := ks.current(alg)
+	ks.mu.RUnlock()
+	if key == nil { return "", fmt.Errorf("no %s signing key", alg) }
+
+	token.Method = signingMethod(key.Alg)
+	token.Header["alg"] = token.Method.Alg()
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.signer)
+}
+
+// verificationKey returns the public key for a kid, checking that the token
+// claims the algorithm that key is used with.
+func (ks *KeySet) verificationKey(kid, alg string) (crypto.PublicKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.Id != kid { continue }
+		if key.Alg != alg { return nil, fmt.Errorf("key %s is not used with %s", kid, alg) }
+		return key.signer.Public(), nil
+	}
+	return nil, ErrUnknownKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"`
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// publicKey parses a key from someone else's JWKS. Ours only have OKP and
+// RSA keys but other providers commonly use EC ones too.
+func (jwk JWK) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil { return nil, err }
+		if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %s", jwk.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil { return nil, err }
+		e, err := decode(jwk.E)
+		if err != nil { return nil, err }
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" { return nil, fmt.Errorf("unsupported EC curve %s", jwk.Crv) }
+		x, err := decode(jwk.X)
+		if err != nil { return nil, err }
+		y, err := decode(jwk.Y)
+		if err != nil { return nil, err }
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) { return nil, fmt.Errorf("invalid EC key %s", jwk.Kid) }
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// JWKS returns the public keys of every key that may have signed a token
+// that's still valid.
+func (ks *KeySet) JWKS() []JWK {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	out := []JWK{}
+	for _, key := range ks.keys {
+		jwk := JWK{ Kid: key.Id, Use: "sig", Alg: key.Alg }
+		switch pub := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		}
+		out = append(out, jwk)
+	}
+	return out
+}
+
+func (cfg *apiConfig) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			Keys []JWK `json:"keys"`
+		}{
+			Keys: cfg.keys.JWKS(),
+		})
+}
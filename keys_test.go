@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestIdTokensSignedWithRS256 checks there's an RS256 key to sign id tokens
+// with whatever JWT_ALG is, and that it's published alongside the main key.
+func TestIdTokensSignedWithRS256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_keys.json")
+	ks, err := LoadKeySet(path, AlgEdDSA, defaultKeyRotation)
+	if err != nil { t.Fatal(err) }
+
+	algs := map[string]bool{}
+	for _, jwk := range ks.JWKS() {
+		algs[jwk.Alg] = true
+	}
+	if len(algs) != 2 || !algs[AlgEdDSA] || !algs[AlgRS256] { t.Fatalf("JWKS has keys for %v, want EdDSA and RS256", algs) }
+
+	for _, alg := range []string{ AlgEdDSA, AlgRS256 } {
+		signed, err := ks.SignedStringWith(jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ Subject: "1" }), alg)
+		if err != nil { t.Fatal(err) }
+		token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return ks.verificationKey(kid, token.Method.Alg())
+		})
+		if err != nil { t.Fatalf("verifying %s token: %s", alg, err) }
+		if token.Method.Alg() != alg { t.Fatalf("token signed with %s, want %s", token.Method.Alg(), alg) }
+	}
+
+	// reloading keeps the keys, switching to RS256 retires the EdDSA one
+	reloaded, err := LoadKeySet(path, AlgEdDSA, defaultKeyRotation)
+	if err != nil { t.Fatal(err) }
+	if len(reloaded.keys) != 2 { t.Fatalf("reloading left %d keys, want the same 2", len(reloaded.keys)) }
+
+	switched, err := LoadKeySet(path, AlgRS256, defaultKeyRotation)
+	if err != nil { t.Fatal(err) }
+	if switched.current(AlgEdDSA) != nil { t.Fatal("EdDSA key is still current after switching to RS256") }
+	if len(switched.keys) != 2 { t.Fatalf("switching left %d keys, the retired one should be kept", len(switched.keys)) }
+	if _, err := switched.SignedString(jwt.New(jwt.SigningMethodHS256)); err != nil { t.Fatal(err) }
+}
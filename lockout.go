@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Failed logins are counted per account and per client IP. After a few free
+// attempts each failure doubles how long the next try has to wait, and past
+// a limit the key is locked out for a while. Counts are forgotten after a
+// quiet spell, or for an account when someone logs into it. It's only kept in
+// memory, so a restart forgets it all.
+
+const (
+	lockoutAccount = "account"
+	lockoutIP = "ip"
+)
+
+const (
+	freeLoginAttempts = 3
+	loginBackoffBase = time.Second
+	loginBackoffMax = 5 * time.Minute
+	accountLockoutAttempts = 10
+	ipLockoutAttempts = 50
+	lockoutDuration = 15 * time.Minute
+	// failures are forgotten this long after the last one
+	loginFailureWindow = time.Hour
+)
+
+type loginAttempts struct {
+	kind string
+	value string
+	failures int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// wait is how long until another attempt is allowed.
+func (a *loginAttempts) wait(now time.Time) time.Duration {
+	if now.Before(a.lockedUntil) { return a.lockedUntil.Sub(now) }
+	if a.failures < freeLoginAttempts { return 0 }
+
+	exp := float64(a.failures - freeLoginAttempts)
+	backoff := time.Duration(math.Min(
+		float64(loginBackoffBase) * math.Pow(2, exp), float64(loginBackoffMax)))
+	return max(a.lastFailure.Add(backoff).Sub(now), 0)
+}
+
+type loginLimiter struct {
+	mu *sync.Mutex
+	entries map[string]*loginAttempts
+	// compared against when the email isn't known, so a login takes as long
+	// whether or not the account exists
+	dummyHash string
+}
+
+func newLoginLimiter(hasher PasswordHasher) *loginLimiter {
+	dummyHash, err := hasher.Hash(randomToken(16))
+	if err != nil { panic(err) }
+
+	return &loginLimiter{
+		mu: &sync.Mutex{},
+		entries: make(map[string]*loginAttempts),
+		dummyHash: dummyHash,
+	}
+}
+
+// loginKeys are the keys a login attempt counts against.
+func loginKeys(email string, r *http.Request) [][2]string {
+	return [][2]string{
+		{ lockoutAccount, normalizeEmail(email) },
+		{ lockoutIP, clientIP(r) },
+	}
+}
+
+// retryAfter is how long until any of keys may try again, zero if they all
+// can now.
+func (l *loginLimiter) retryAfter(keys [][2]string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wait := time.Duration(0)
+	for _, key := range keys {
+		if a, ok := l.entries[key[0] + ":" + key[1]]; ok {
+			wait = max(wait, a.wait(now))
+		}
+	}
+	return wait
+}
+
+func (l *loginLimiter) fail(keys [][2]string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		a, ok := l.entries[key[0] + ":" + key[1]]
+		if !ok || now.Sub(a.lastFailure) > loginFailureWindow {
+			a = &loginAttempts{ kind: key[0], value: key[1] }
+			l.entries[key[0] + ":" + key[1]] = a
+		}
+
+		a.failures++
+		a.lastFailure = now
+
+		limit := accountLockoutAttempts
+		if a.kind == lockoutIP { limit = ipLockoutAttempts }
+		if a.failures >= limit {
+			a.lockedUntil = now.Add(lockoutDuration)
+			if a.failures == limit {
+				log.Printf("Locked out %s %s after %d failed logins", a.kind, a.value, a.failures)
+			}
+		}
+	}
+}
+
+// clear forgets the failures for one key, returning whether there were any.
+func (l *loginLimiter) clear(kind, value string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.entries[kind + ":" + value]
+	delete(l.entries, kind + ":" + value)
+	return ok
+}
+
+func (l *loginLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, a := range l.entries {
+		if now.Sub(a.lastFailure) > loginFailureWindow && !now.Before(a.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// run prunes forgotten entries every interval until done is closed.
+func (l *loginLimiter) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.prune(time.Now())
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkLoginAllowed responds with 429 and returns false if keys have to wait
+// before trying again.
+func (cfg *apiConfig) checkLoginAllowed(w http.ResponseWriter, keys [][2]string) bool {
+	wait := cfg.limiter.retryAfter(keys, cfg.now())
+	if wait <= 0 { return true }
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, "Too many failed attempts, try again later")
+	return false
+}
+
+type Lockout struct {
+	Kind string `json:"kind"`
+	Value string `json:"value"`
+	Failures int `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	Locked bool `json:"locked"`
+	RetryAfter int `json:"retry_after"`
+}
+
+func (cfg *apiConfig) lockoutsGetHandler(w http.ResponseWriter, r *http.Request) {
+	now := cfg.now()
+
+	cfg.limiter.mu.Lock()
+	out := []Lockout{}
+	for _, a := range cfg.limiter.entries {
+		if now.Sub(a.lastFailure) > loginFailureWindow && !now.Before(a.lockedUntil) { continue }
+		out = append(out, Lockout{
+			Kind: a.kind,
+			Value: a.value,
+			Failures: a.failures,
+			LastFailure: a.lastFailure,
+			Locked: now.Before(a.lockedUntil),
+			RetryAfter: int(math.Ceil(a.wait(now).Seconds())),
+		})
+	}
+	cfg.limiter.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b Lockout) int { return cmp.Compare(b.Failures, a.Failures) })
+	respondWithJSON(w, http.StatusOK, out)
+}
+
+func (cfg *apiConfig) lockoutDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	kind, value := chi.URLParam(r, "kind"), chi.URLParam(r, "value")
+	if kind != lockoutAccount && kind != lockoutIP {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown lockout kind %q", kind))
+		return
+	}
+	if kind == lockoutAccount { value = normalizeEmail(value) }
+
+	if !cfg.limiter.clear(kind, value) {
+		respondWithError(w, http.StatusNotFound, "No failed logins recorded for that")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To string
+	Subject string
+	Body string
+}
+
+// Mailer sends mail to users. SMTPMailer is for real use, FileMailer writes
+// the messages somewhere local to read during development.
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+type SMTPMailer struct {
+	// host:port of the server
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(addr, from, username, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil { return nil, fmt.Errorf("SMTP_ADDR: %w", err) }
+
+	m := &SMTPMailer{ addr: addr, from: from }
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(mail Mail) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{ mail.To }, formatMail(m.from, mail))
+}
+
+type FileMailer struct {
+	mu *sync.Mutex
+	w io.Writer
+	from string
+}
+
+// NewFileMailer appends messages to the file at path, or writes them to
+// stdout if path is empty.
+func NewFileMailer(path, from string) (*FileMailer, error) {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil { return nil, err }
+		w = f
+	}
+	return &FileMailer{ mu: &sync.Mutex{}, w: w, from: from }, nil
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.w.Write(append(formatMail(m.from, mail), '\n'))
+	return err
+}
+
+// headerValue keeps a value from starting headers of its own.
+var headerValue = strings.NewReplacer("\r", "", "\n", "")
+
+func formatMail(from string, mail Mail) []byte {
+	headers := []string{
+		"From: " + headerValue.Replace(from),
+		"To: " + headerValue.Replace(mail.To),
+		"Subject: " + headerValue.Replace(mail.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + mail.Body + "\r\n")
+}
+
+func mailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" { from = "chirpy@localhost" }
+
+	switch driver := os.Getenv("MAIL_DRIVER"); driver {
+	case "", "file":
+		return NewFileMailer(os.Getenv("MAIL_FILE"), from)
+	case "smtp":
+		return NewSMTPMailer(os.Getenv("SMTP_ADDR"), from,
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
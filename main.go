@@ -5,6 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
@@ -12,28 +15,149 @@ import (
 
 type apiConfig struct {
 	fileserverHits int
-	db *DB
+	db Store
 	jwtSecret string
+	// tokens signed with jwtSecret are refused from then on
+	jwtSecretUntil time.Time
+	keys *KeySet
 	polkaKey string
+	snapshots *SnapshotManager
+	sweeper *tokenSweeper
+	hasher PasswordHasher
+	limiter *loginLimiter
+	policy *PasswordPolicy
+	authCodes *authCodeStore
+	// external OIDC providers users can log in with, by name
+	providers map[string]*oidcProvider
+	pendingLogins *pendingLoginStore
+	mailer Mailer
+	// what unverified users aren't allowed to do
+	verifiedOnly []string
+	// publicURL is where the site is reached from outside, for links in
+	// mail
+	publicURL string
+	// clock stands in for time.Now when set
+	clock func() time.Time
+}
+
+func (cfg *apiConfig) now() time.Time {
+	if cfg.clock != nil { return cfg.clock() }
+	return time.Now()
 }
 
 const PORT = "8080"
-const ROOTPATH = "."
+// only this directory is served under /app, the working directory holds the
+// database files and signing keys
+const ROOTPATH = "static"
 
 func main() {
 	godotenv.Load()
-	dbs, err := NewDB("database.json")
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:])
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	dbOpts, err := dbOptionsFromEnv()
+	if err != nil {
+		fmt.Printf("Error reading database options: %s", err)
+		return
+	}
+	dbs, err := OpenStore(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), dbOpts)
 	if err != nil {
 		fmt.Printf("Error loading database: %s", err)
 		return
 	}
 
+	keys, err := keySetFromEnv()
+	if err != nil {
+		fmt.Printf("Error loading JWT signing keys: %s", err)
+		return
+	}
+
+	jwtSecretUntil, err := jwtSecretUntilFromEnv()
+	if err != nil {
+		fmt.Printf("Error reading JWT_SECRET_UNTIL: %s", err)
+		return
+	}
+	go keys.Run(time.Hour, nil)
+
+	mailer, err := mailerFromEnv()
+	if err != nil {
+		fmt.Printf("Error setting up mail: %s", err)
+		return
+	}
+
+	verifiedOnly, err := verifiedOnlyFromEnv()
+	if err != nil {
+		fmt.Printf("Error reading verification options: %s", err)
+		return
+	}
+
+	hasher, err := passwordHasherFromEnv()
+	if err != nil {
+		fmt.Printf("Error reading password hashing options: %s", err)
+		return
+	}
+
+	policy, err := passwordPolicyFromEnv()
+	if err != nil {
+		fmt.Printf("Error reading password policy: %s", err)
+		return
+	}
+
+	providers, err := oidcProvidersFromEnv()
+	if err != nil {
+		fmt.Printf("Error reading login providers: %s", err)
+		return
+	}
+
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" { publicURL = "http://localhost:" + PORT }
+
 	apicfg := apiConfig{
 		fileserverHits: 0,
 		db: dbs,
 		jwtSecret: os.Getenv("JWT_SECRET"),
+		jwtSecretUntil: jwtSecretUntil,
+		keys: keys,
 		polkaKey: os.Getenv("POLKA_KEY"),
+		sweeper: newTokenSweeper(dbs),
+		hasher: hasher,
+		limiter: newLoginLimiter(hasher),
+		policy: policy,
+		authCodes: newAuthCodeStore(),
+		providers: providers,
+		pendingLogins: newPendingLoginStore(),
+		mailer: mailer,
+		verifiedOnly: verifiedOnly,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+	}
+
+	sweepInterval, err := durationFromEnv("TOKEN_SWEEP_INTERVAL")
+	if err != nil {
+		fmt.Printf("Error reading sweeper options: %s", err)
+		return
+	}
+	if sweepInterval == 0 { sweepInterval = defaultSweepInterval }
+	go apicfg.sweeper.run(sweepInterval, nil)
+	go apicfg.limiter.run(10 * time.Minute, nil)
+
+	if source, ok := dbs.(Snapshotter); ok {
+		snapshots, interval, err := snapshotManagerFromEnv(source)
+		if err != nil {
+			fmt.Printf("Error reading snapshot options: %s", err)
+			return
+		}
+		apicfg.snapshots = snapshots
+		if interval > 0 {
+			go snapshots.Run(interval, nil)
+		}
 	}
+
 	mainMux := chi.NewRouter()
 	apiMux := chi.NewRouter()
 	adminMux := chi.NewRouter()
@@ -42,19 +166,59 @@ func main() {
 
 	mainMux.Handle("/app/*", fsHandler)
 	mainMux.Handle("/app", fsHandler)
+	mainMux.Get("/.well-known/jwks.json", apicfg.jwksHandler)
+	mainMux.Get("/.well-known/openid-configuration", apicfg.openIDConfigurationHandler)
+	mainMux.Get("/oauth/authorize", apicfg.authorizeGetHandler)
+	mainMux.Post("/oauth/authorize", apicfg.authorizePostHandler)
+	mainMux.Post("/oauth/token", apicfg.tokenPostHandler)
+	mainMux.With(apicfg.middlewareAuth, apicfg.requireScope(ScopeOpenID)).Get("/oauth/userinfo", apicfg.userinfoHandler)
+	mainMux.With(apicfg.middlewareAuth, apicfg.requireScope(ScopeOpenID)).Post("/oauth/userinfo", apicfg.userinfoHandler)
 	apiMux.Get("/healthz", readinessHandler)
-	apiMux.Get("/reset", apicfg.resetHandler)
-	apiMux.Post("/chirps", apicfg.chirpPostHandler)
 	apiMux.Post("/users", apicfg.userPostHandler)
-	apiMux.Put("/users", apicfg.userPutHandler)
 	apiMux.Post("/login", apicfg.loginPostHandler)
+	apiMux.Post("/login/mfa", apicfg.loginMFAPostHandler)
+	apiMux.Get("/auth/{provider}", apicfg.externalLoginHandler)
+	apiMux.Get("/auth/{provider}/callback", apicfg.externalCallbackHandler)
+	apiMux.Post("/password/forgot", apicfg.passwordForgotPostHandler)
+	apiMux.Post("/password/reset", apicfg.passwordResetPostHandler)
+	apiMux.Get("/verify", apicfg.verifyGetHandler)
 	apiMux.Post("/refresh", apicfg.refreshPostHandler)
 	apiMux.Post("/revoke", apicfg.revokePostHandler)
-	apiMux.Get("/chirps", apicfg.chirpGetHandler)
-	apiMux.Get("/chirps/{id}", apicfg.chirpGetIdHandler)
-	apiMux.Delete("/chirps/{id}", apicfg.chirpDeleteIdHandler)
+	apiMux.Group(func(r chi.Router) {
+		r.Use(apicfg.middlewareAuth)
+		r.With(apicfg.requireScope(ScopeChirpsWrite)).Post("/chirps", apicfg.chirpPostHandler)
+		r.With(apicfg.requireScope(ScopeChirpsWrite)).Delete("/chirps/{id}", apicfg.chirpDeleteIdHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Patch("/users", apicfg.userPatchHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Put("/users", apicfg.userPatchHandler)
+		r.With(apicfg.requireScope(ScopeAccountRead)).Get("/sessions", apicfg.sessionsGetHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Delete("/sessions", apicfg.sessionsDeleteHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Delete("/sessions/{id}", apicfg.sessionDeleteIdHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Post("/verify/resend", apicfg.verifyResendPostHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite), apicfg.requireFirstParty).Post("/auth/{provider}/link", apicfg.externalLinkPostHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite), apicfg.requireFirstParty).Post("/2fa/enroll", apicfg.totpEnrollPostHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite), apicfg.requireFirstParty).Post("/2fa/activate", apicfg.totpActivatePostHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite), apicfg.requireFirstParty).Delete("/2fa", apicfg.totpDeleteHandler)
+		r.With(apicfg.requireScope(ScopeAccountRead)).Get("/apikeys", apicfg.apiKeysGetHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite), apicfg.requireFirstParty).Post("/apikeys", apicfg.apiKeyPostHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Delete("/apikeys/{id}", apicfg.apiKeyDeleteIdHandler)
+		r.With(apicfg.requireScope(ScopeAccountRead)).Get("/oauth/clients", apicfg.oauthClientsGetHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite), apicfg.requireFirstParty).Post("/oauth/clients", apicfg.oauthClientPostHandler)
+		r.With(apicfg.requireScope(ScopeAccountWrite)).Delete("/oauth/clients/{id}", apicfg.oauthClientDeleteIdHandler)
+		r.With(apicfg.requireScope(ScopeAdmin), apicfg.requireRole(RoleAdmin)).Get("/reset", apicfg.resetHandler)
+	})
+	apiMux.Group(func(r chi.Router) {
+		r.Use(apicfg.middlewareOptionalAuth, apicfg.requireScope(ScopeChirpsRead))
+		r.Get("/chirps", apicfg.chirpGetHandler)
+		r.Get("/chirps/{id}", apicfg.chirpGetIdHandler)
+	})
 	apiMux.Post("/polka/webhooks", apicfg.polkaPostHandler)
+	adminMux.Use(apicfg.middlewareAuth, apicfg.requireScope(ScopeAdmin), apicfg.requireRole(RoleAdmin))
 	adminMux.Get("/metrics", apicfg.metricsHandler)
+	adminMux.Post("/snapshots", apicfg.snapshotPostHandler)
+	adminMux.Get("/snapshots", apicfg.snapshotGetHandler)
+	adminMux.Put("/users/{id}/role", apicfg.userRolePutHandler)
+	adminMux.Get("/lockouts", apicfg.lockoutsGetHandler)
+	adminMux.Delete("/lockouts/{kind}/{value}", apicfg.lockoutDeleteHandler)
 
 	mainMux.Mount("/api", apiMux)
 	mainMux.Mount("/admin", adminMux)
@@ -68,11 +232,102 @@ func main() {
 	log.Fatal(server.ListenAndServe())
 }
 
+// jwtSecretUntil reads when tokens signed with JWT_SECRET, from before the
+// switch to key sets, stop being accepted. It should be far enough past the
+// switch for the old refresh tokens to run out, and without it they're
+// refused straight away, since otherwise anyone who ever had the secret
+// could mint tokens forever.
+func jwtSecretUntilFromEnv() (time.Time, error) {
+	str := os.Getenv("JWT_SECRET_UNTIL")
+	if str == "" {
+		if os.Getenv("JWT_SECRET") != "" {
+			log.Printf("JWT_SECRET is set without JWT_SECRET_UNTIL, tokens signed with it won't be accepted")
+		}
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+func dbOptionsFromEnv() (DBOptions, error) {
+	opts := DBOptions{}
+	interval, err := durationFromEnv("DB_SYNC_INTERVAL")
+	if err != nil { return opts, err }
+
+	opts.SyncInterval = interval
+	opts.WatchFile = os.Getenv("DB_WATCH_FILE") == "true"
+
+	key := os.Getenv("DB_ENCRYPTION_KEY")
+	oldKeys := os.Getenv("DB_ENCRYPTION_OLD_KEYS")
+	if key != "" || oldKeys != "" {
+		migrating := os.Getenv("DB_ENCRYPTION_MIGRATE") == "true"
+		opts.Keys, err = NewKeyRing(key, splitList(oldKeys), migrating)
+		if err != nil { return opts, err }
+	}
+	return opts, nil
+}
+
+// snapshotManagerFromEnv also returns how often automatic snapshots should
+// be taken, zero if they're off.
+func snapshotManagerFromEnv(source Snapshotter) (*SnapshotManager, time.Duration, error) {
+	dir := os.Getenv("SNAPSHOT_DIR")
+	if dir == "" { dir = "snapshots" }
+
+	keep := 7
+	if keepStr := os.Getenv("SNAPSHOT_KEEP"); keepStr != "" {
+		n, err := strconv.Atoi(keepStr)
+		if err != nil { return nil, 0, fmt.Errorf("SNAPSHOT_KEEP: %w", err) }
+		keep = n
+	}
+
+	maxAge, err := durationFromEnv("SNAPSHOT_MAX_AGE")
+	if err != nil { return nil, 0, err }
+
+	interval, err := durationFromEnv("SNAPSHOT_INTERVAL")
+	if err != nil { return nil, 0, err }
+
+	return NewSnapshotManager(dir, source, keep, maxAge), interval, nil
+}
+
+func keySetFromEnv() (*KeySet, error) {
+	path := os.Getenv("JWT_KEYS_PATH")
+	if path == "" { path = "jwt_keys.json" }
+
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" { alg = AlgEdDSA }
+
+	rotation, err := durationFromEnv("JWT_KEY_ROTATION")
+	if err != nil { return nil, err }
+	if rotation == 0 { rotation = defaultKeyRotation }
+
+	return LoadKeySet(path, alg, rotation)
+}
+
+// durationFromEnv returns zero when the variable isn't set.
+func durationFromEnv(name string) (time.Duration, error) {
+	str := os.Getenv(name)
+	if str == "" { return 0, nil }
+
+	d, err := time.ParseDuration(str)
+	if err != nil { return 0, fmt.Errorf("%s: %w", name, err) }
+	return d, nil
+}
+
+// splitList splits a comma separated env var, dropping empty items.
+func splitList(s string) []string {
+	out := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods",
-			"GET, POST, OPTIONS, PUT, DELETE")
+			"GET, POST, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type contextKey int
+
+const authContextKey contextKey = iota
+
+// authInfo is who made a request and what they're allowed to do with it.
+type authInfo struct {
+	user User
+	scopes []string
+	// the OAuth client the token was issued to, empty for the user's own
+	// logins and api keys
+	clientId string
+}
+
+// middlewareAuth only lets requests with a valid access token or api key
+// through, and puts the user it belongs to in the request context.
+func (cfg *apiConfig) middlewareAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := cfg.authenticate(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey, info)))
+	})
+}
+
+// middlewareOptionalAuth is middlewareAuth for routes that anyone can use.
+// Requests without an Authorization header go through anonymously, but a
+// token that's sent still has to be valid.
+func (cfg *apiConfig) middlewareOptionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg.middlewareAuth(next).ServeHTTP(w, r)
+	})
+}
+
+// UserFromContext returns the user the auth middleware authenticated, ok is
+// false on anonymous requests.
+func UserFromContext(ctx context.Context) (User, bool) {
+	info, ok := ctx.Value(authContextKey).(authInfo)
+	return info.user, ok
+}
+
+// ScopesFromContext returns what the request's token or api key may do.
+func ScopesFromContext(ctx context.Context) []string {
+	info, _ := ctx.Value(authContextKey).(authInfo)
+	return info.scopes
+}
+
+// authenticate checks the request's access token or api key and loads the
+// user it was issued to.
+func (cfg *apiConfig) authenticate(r *http.Request) (authInfo, error) {
+	tok, err := GetBearerToken(r.Header)
+	if err != nil { return authInfo{}, err }
+
+	var id int
+	var scopes []string
+	clientId := ""
+	if strings.HasPrefix(tok, apiKeyPrefix) {
+		key, err := cfg.db.GetAPIKey(hashToken(tok))
+		if errors.Is(err, ErrNotExist) { return authInfo{}, errors.New("invalid api key") }
+		if err != nil { return authInfo{}, err }
+		if !cfg.now().Before(key.ExpiresAt) { return authInfo{}, errors.New("api key has expired") }
+
+		id, scopes = key.UserId, key.Scopes
+	} else {
+		claims, err := cfg.validateJWT(tok, "access")
+		if err != nil { return authInfo{}, err }
+
+		id, err = strconv.Atoi(claims.Subject)
+		if err != nil { return authInfo{}, err }
+		scopes = claims.scopes()
+		clientId = claims.ClientId
+	}
+
+	user, err := cfg.db.GetUserFromId(id)
+	if errors.Is(err, ErrNotExist) { return authInfo{}, errors.New("user no longer exists") }
+	if err != nil { return authInfo{}, err }
+
+	return authInfo{ user: user, scopes: scopes, clientId: clientId }, nil
+}
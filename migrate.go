@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// migrations upgrade a loaded database one schema version at a time. The
+// migration at index i takes a database from version i to version i + 1, so
+// new ones only ever get appended to the end. They run on the state after
+// the log has been replayed, and the files as they were before migrating are
+// kept next to the database as backups.
+var migrations = []struct {
+	description string
+	up func(*DBStructure) error
+}{
+	{ "add id sequences", migrateSequences },
+	{ "add refresh token expiry", migrateTokenExpiry },
+	{ "add refresh token families", migrateTokenFamilies },
+	{ "add user roles", migrateUserRoles },
+	{ "add email verification", migrateVerified },
+	{ "replace refresh token families named after their token", migrateTokenFamilyIds },
+}
+
+var currentSchemaVersion = len(migrations)
+
+// migrate brings dbs up to currentSchemaVersion and reports whether anything
+// had to be done. Callers must hold db.mu for writing.
+func (db *DB) migrate(dbs *DBStructure) (bool, error) {
+	from := dbs.SchemaVersion
+	if from > currentSchemaVersion {
+		return false, fmt.Errorf(
+			"database schema version %d is newer than the supported version %d",
+			from, currentSchemaVersion)
+	}
+	if from == currentSchemaVersion { return false, nil }
+
+	err := db.backupFiles(fmt.Sprintf(".v%d.bak", from))
+	if err != nil { return false, fmt.Errorf("backing up before migration: %w", err) }
+
+	for v := from; v < currentSchemaVersion; v++ {
+		log.Printf("Migrating database to version %d: %s",
+			v + 1, migrations[v].description)
+
+		err := migrations[v].up(dbs)
+		if err != nil {
+			return false, fmt.Errorf("migrating to version %d: %w", v + 1, err)
+		}
+		dbs.SchemaVersion = v + 1
+	}
+	return true, nil
+}
+
+func (db *DB) backupFiles(suffix string) error {
+	for _, path := range []string{ db.path, db.logPath() } {
+		err := copyFile(path, path + suffix)
+		if err != nil && !os.IsNotExist(err) { return err }
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil { return err }
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil { return err }
+
+	_, err = io.Copy(out, in)
+	if err == nil { err = out.Sync() }
+	if cerr := out.Close(); err == nil { err = cerr }
+	return err
+}
+
+// version 1: ids come from per table sequences instead of the table size
+func migrateSequences(dbs *DBStructure) error {
+	for id := range dbs.Users {
+		dbs.Sequences[tableUsers] = max(dbs.Sequences[tableUsers], id)
+	}
+	for id := range dbs.Chirps {
+		dbs.Sequences[tableChirps] = max(dbs.Sequences[tableChirps], id)
+	}
+	return nil
+}
+
+// version 2: refresh tokens record when they expire. Older ones didn't, but
+// none of them can outlive the refresh token lifetime from now.
+func migrateTokenExpiry(dbs *DBStructure) error {
+	expiresAt := time.Now().UTC().Add(refreshTokenLifetime)
+	for token, refreshToken := range dbs.Tokens {
+		if refreshToken.ExpiresAt.IsZero() {
+			refreshToken.ExpiresAt = expiresAt
+			dbs.Tokens[token] = refreshToken
+		}
+	}
+	return nil
+}
+
+// version 3: refresh tokens belong to a family. Each existing token is the
+// only one in its own. The family id is listed with the user's sessions so it
+// can't be the token itself.
+func migrateTokenFamilies(dbs *DBStructure) error {
+	for token, refreshToken := range dbs.Tokens {
+		if refreshToken.Family == "" {
+			refreshToken.Family = randomToken(16)
+			dbs.Tokens[token] = refreshToken
+		}
+	}
+	return nil
+}
+
+// version 4: users have a role, everyone who signed up before is a plain
+// user
+func migrateUserRoles(dbs *DBStructure) error {
+	for id, user := range dbs.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			dbs.Users[id] = user
+		}
+	}
+	return nil
+}
+
+// version 5: users verify their email. Accounts from before that was asked
+// for are trusted as they are.
+func migrateVerified(dbs *DBStructure) error {
+	for id, user := range dbs.Users {
+		user.Verified = true
+		dbs.Users[id] = user
+	}
+	return nil
+}
+
+// version 6: version 3 used to name each family after its token, which the
+// sessions list then gave away. Those get a random id like any other family.
+func migrateTokenFamilyIds(dbs *DBStructure) error {
+	for token, refreshToken := range dbs.Tokens {
+		if refreshToken.Family == token {
+			refreshToken.Family = randomToken(16)
+			dbs.Tokens[token] = refreshToken
+		}
+	}
+	return nil
+}
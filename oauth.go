@@ -0,0 +1,779 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Chirpy is an OAuth 2 authorization server with OpenID Connect on top, so
+// other apps can act for a user without ever seeing their password. Only
+// the authorization code flow is supported and every client has to use PKCE
+// with S256, confidential clients also authenticate with their secret. The
+// tokens handed out are ordinary access and refresh tokens limited to the
+// scopes the user agreed to.
+
+const (
+	ScopeOpenID = "openid"
+	ScopeEmail = "email"
+)
+
+// oauthScopes are what a client can ask for. admin is left out on purpose,
+// no third party app gets to use the admin endpoints.
+var oauthScopes = []string{
+	ScopeOpenID,
+	ScopeEmail,
+	ScopeChirpsRead,
+	ScopeChirpsWrite,
+	ScopeAccountRead,
+	ScopeAccountWrite,
+}
+
+// what the consent page tells the user each scope allows
+var scopeDescriptions = map[string]string{
+	ScopeOpenID: "Know who you are on Chirpy",
+	ScopeEmail: "See your email address",
+	ScopeChirpsRead: "Read chirps",
+	ScopeChirpsWrite: "Post and delete chirps as you",
+	ScopeAccountRead: "See your account details, sessions and api keys",
+	ScopeAccountWrite: "Change your account, including your email and password",
+}
+
+const (
+	oauthCodeLifetime = time.Minute
+	idTokenLifetime = time.Hour
+	oauthClientPrefix = "client_"
+	maxRedirectURIs = 10
+)
+
+type oauthError struct {
+	code string
+	description string
+}
+
+func (e oauthError) Error() string {
+	return e.code + ": " + e.description
+}
+
+func respondWithOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, status,
+		struct{
+			Error string `json:"error"`
+			Description string `json:"error_description,omitempty"`
+		}{
+			Error: code,
+			Description: description,
+		})
+}
+
+// validRedirectURI only allows absolute https uris, or http ones back to
+// the machine itself for apps running locally.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" || strings.ContainsAny(uri, " \t\r\n") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// parseOAuthScopes splits a scope parameter, rejecting anything a client
+// can't ask for.
+func parseOAuthScopes(scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 { return nil, oauthError{ "invalid_scope", "scope is required" } }
+
+	for _, s := range scopes {
+		if !slices.Contains(oauthScopes, s) {
+			return nil, oauthError{ "invalid_scope", "unknown scope " + s }
+		}
+	}
+	slices.Sort(scopes)
+	return slices.Compact(scopes), nil
+}
+
+// authorizationCode is what a code from the consent page stands for until
+// the client exchanges it.
+type authorizationCode struct {
+	clientId string
+	redirectURI string
+	userId int
+	scopes []string
+	challenge string
+	nonce string
+	authTime time.Time
+	expiresAt time.Time
+}
+
+// authCodeStore keeps codes in memory by hash. They only live a minute, so
+// losing them on a restart just means the user has to try again.
+type authCodeStore struct {
+	mu *sync.Mutex
+	codes map[string]authorizationCode
+}
+
+func newAuthCodeStore() *authCodeStore {
+	return &authCodeStore{
+		mu: &sync.Mutex{},
+		codes: make(map[string]authorizationCode),
+	}
+}
+
+// add stores a code and returns it, dropping any that have expired.
+func (s *authCodeStore) add(code authorizationCode, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, other := range s.codes {
+		if !now.Before(other.expiresAt) { delete(s.codes, hash) }
+	}
+
+	token := randomToken(32)
+	s.codes[hashToken(token)] = code
+	return token
+}
+
+// take removes a code and returns it, ok is false if it doesn't exist or
+// has expired. Codes can only be taken once.
+func (s *authCodeStore) take(token string, now time.Time) (authorizationCode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code, ok := s.codes[hashToken(token)]
+	delete(s.codes, hashToken(token))
+	if !ok || !now.Before(code.expiresAt) { return authorizationCode{}, false }
+	return code, true
+}
+
+// forClient marks a token as issued to an OAuth client.
+func forClient(token *jwt.Token, clientId string) *jwt.Token {
+	claims := token.Claims.(tokenClaims)
+	claims.ClientId = clientId
+	token.Claims = claims
+	return token
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	Email string `json:"email,omitempty"`
+	EmailVerified *bool `json:"email_verified,omitempty"`
+}
+
+// authorizeRequest is a checked request to /oauth/authorize. Its params are
+// carried through the consent form as they came.
+type authorizeRequest struct {
+	client OAuthClient
+	redirectURI string
+	scopes []string
+	state string
+	challenge string
+	nonce string
+	params url.Values
+}
+
+var authorizeParams = []string{
+	"response_type", "client_id", "redirect_uri", "scope", "state",
+	"code_challenge", "code_challenge_method", "nonce",
+}
+
+// parseAuthorizeRequest checks the params of an authorization request. If
+// the client and redirect uri are fine the error is an oauthError to send
+// back to the client, otherwise redirectURI is empty and the error can only
+// be shown to the user.
+func (cfg *apiConfig) parseAuthorizeRequest(values url.Values) (authorizeRequest, error) {
+	req := authorizeRequest{ params: url.Values{} }
+	for _, param := range authorizeParams {
+		if v := values.Get(param); v != "" { req.params.Set(param, v) }
+	}
+
+	client, err := cfg.db.GetOAuthClient(values.Get("client_id"))
+	if errors.Is(err, ErrNotExist) { return req, errors.New("unknown client") }
+	if err != nil { return req, err }
+	req.client = client
+
+	redirectURI := values.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return req, errors.New("redirect_uri is not registered for this client")
+	}
+	req.redirectURI = redirectURI
+	req.state = values.Get("state")
+
+	if values.Get("response_type") != "code" {
+		return req, oauthError{ "unsupported_response_type", "only the code response type is supported" }
+	}
+	req.scopes, err = parseOAuthScopes(values.Get("scope"))
+	if err != nil { return req, err }
+
+	req.challenge = values.Get("code_challenge")
+	if req.challenge == "" || values.Get("code_challenge_method") != "S256" {
+		return req, oauthError{ "invalid_request", "PKCE with code_challenge_method S256 is required" }
+	}
+	req.nonce = values.Get("nonce")
+	return req, nil
+}
+
+// redirect sends the user back to the client with params added to its
+// redirect uri.
+func (req authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	u, _ := url.Parse(req.redirectURI)
+	query := u.Query()
+	for k := range params { query.Set(k, params.Get(k)) }
+	if req.state != "" { query.Set("state", req.state) }
+	u.RawQuery = query.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// fail sends err back to the client if it can be, or shows it to the user
+// if the request is too broken to trust its redirect uri.
+func (req authorizeRequest) fail(w http.ResponseWriter, r *http.Request, err error) {
+	oerr, ok := err.(oauthError)
+	if !ok || req.redirectURI == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		authorizeErrorPage.Execute(w, err.Error())
+		return
+	}
+
+	params := url.Values{}
+	params.Set("error", oerr.code)
+	params.Set("error_description", oerr.description)
+	req.redirect(w, r, params)
+}
+
+var authorizeErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+	<head><title>Chirpy</title></head>
+	<body>
+		<h1>Can't sign in with Chirpy</h1>
+		<p>{{.}}</p>
+	</body>
+</html>
+`))
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+	<head><title>Sign in to {{.Client}} with Chirpy</title></head>
+	<body>
+		<h1>{{.Client}} wants to use your Chirpy account</h1>
+		<p>If you allow it, it will be able to:</p>
+		<ul>
+			{{range .Scopes}}<li>{{.}}</li>
+			{{end}}
+		</ul>
+		{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+		<form method="post" action="/oauth/authorize">
+			{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+			{{end}}
+			<p><label>Email <input type="email" name="email" value="{{.Email}}" required></label></p>
+			<p><label>Password <input type="password" name="password" required></label></p>
+			<p><label>Two-factor code, if you've turned it on <input name="code" inputmode="numeric" autocomplete="one-time-code"></label></p>
+			<button name="decision" value="allow">Allow</button>
+			<button name="decision" value="deny" formnovalidate>Deny</button>
+		</form>
+	</body>
+</html>
+`))
+
+func (cfg *apiConfig) renderConsent(w http.ResponseWriter, status int, req authorizeRequest, email, message string) {
+	scopes := []string{}
+	for _, scope := range req.scopes {
+		scopes = append(scopes, scopeDescriptions[scope])
+	}
+
+	// the page takes a password, so it mustn't be framed by another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := consentPage.Execute(w, struct{
+		Client string
+		Scopes []string
+		Params url.Values
+		Email string
+		Error string
+	}{
+		Client: req.client.Name,
+		Scopes: scopes,
+		Params: req.params,
+		Email: email,
+		Error: message,
+	})
+	if err != nil { log.Printf("Error rendering consent page: %s", err) }
+}
+
+// authorizeGetHandler is where clients send users to sign in. It shows what
+// the client is asking for with a form to sign in and allow it.
+func (cfg *apiConfig) authorizeGetHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := cfg.parseAuthorizeRequest(r.URL.Query())
+	if err != nil {
+		req.fail(w, r, err)
+		return
+	}
+
+	cfg.renderConsent(w, http.StatusOK, req, "", "")
+}
+
+// authorizePostHandler is the consent form being sent. The user signs in
+// right there, with the same throttling as /api/login, and on allow is sent
+// back to the client with a code.
+func (cfg *apiConfig) authorizePostHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	req, err := cfg.parseAuthorizeRequest(r.PostForm)
+	if err != nil {
+		req.fail(w, r, err)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "allow" {
+		req.fail(w, r, oauthError{ "access_denied", "the user denied the request" })
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	keys := loginKeys(email, r)
+	if cfg.limiter.retryAfter(keys, cfg.now()) > 0 {
+		cfg.renderConsent(w, http.StatusTooManyRequests, req, email, "Too many failed attempts, try again later")
+		return
+	}
+
+	user, err := cfg.checkPassword(keys, email, r.PostForm.Get("password"))
+	if errors.Is(err, ErrBadCredentials) {
+		cfg.renderConsent(w, http.StatusUnauthorized, req, email, "Incorrect email or password")
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking password for OAuth consent: %s", err)
+		cfg.renderConsent(w, http.StatusInternalServerError, req, email, "Something went wrong, try again")
+		return
+	}
+
+	if user.TOTP.Enabled {
+		code := r.PostForm.Get("code")
+		if code == "" {
+			cfg.renderConsent(w, http.StatusUnauthorized, req, email, "Enter the code from your authenticator app")
+			return
+		}
+		if err := cfg.verifySecondFactor(user, code, ""); err != nil {
+			cfg.limiter.fail(keys, cfg.now())
+			cfg.renderConsent(w, http.StatusUnauthorized, req, email, "Incorrect two-factor code")
+			return
+		}
+	}
+	cfg.limiter.clear(lockoutAccount, normalizeEmail(user.Email))
+
+	now := cfg.now()
+	code := cfg.authCodes.add(authorizationCode{
+		clientId: req.client.Id,
+		redirectURI: req.redirectURI,
+		userId: user.Id,
+		scopes: req.scopes,
+		challenge: req.challenge,
+		nonce: req.nonce,
+		authTime: now,
+		expiresAt: now.Add(oauthCodeLifetime),
+	}, now)
+
+	req.redirect(w, r, url.Values{ "code": { code } })
+}
+
+// authenticateClient checks the client credentials sent to the token
+// endpoint, in a basic auth header or the form. Public clients only send
+// their id.
+func (cfg *apiConfig) authenticateClient(r *http.Request) (OAuthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// basic auth credentials are form encoded first
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := cfg.db.GetOAuthClient(id)
+	if errors.Is(err, ErrNotExist) { return OAuthClient{}, oauthError{ "invalid_client", "unknown client" } }
+	if err != nil { return OAuthClient{}, err }
+
+	if client.SecretHash == "" { return client, nil }
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return OAuthClient{}, oauthError{ "invalid_client", "client authentication failed" }
+	}
+	return client, nil
+}
+
+func (cfg *apiConfig) tokenPostHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "couldn't decode parameters")
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	var oerr oauthError
+	if errors.As(err, &oerr) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		respondWithOAuthError(w, http.StatusUnauthorized, oerr.code, oerr.description)
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "authorization_code":
+		cfg.exchangeCode(w, r, client)
+	case "refresh_token":
+		cfg.exchangeRefreshToken(w, r, client)
+	default:
+		respondWithOAuthError(w, http.StatusBadRequest, "unsupported_grant_type",
+			"grant_type has to be authorization_code or refresh_token")
+	}
+}
+
+// checkPKCE reports whether verifier hashes to the S256 challenge.
+func checkPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 { return false }
+
+	sum := sha256.Sum256([]byte(verifier))
+	want := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(want), []byte(challenge)) == 1
+}
+
+func (cfg *apiConfig) exchangeCode(w http.ResponseWriter, r *http.Request, client OAuthClient) {
+	now := cfg.now()
+	code, ok := cfg.authCodes.take(r.PostForm.Get("code"), now)
+	if !ok || code.clientId != client.Id {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != code.redirectURI {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match")
+		return
+	}
+	if !checkPKCE(r.PostForm.Get("code_verifier"), code.challenge) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match")
+		return
+	}
+
+	user, err := cfg.db.GetUserFromId(code.userId)
+	if errors.Is(err, ErrNotExist) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "user no longer exists")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	idStr := strconv.Itoa(user.Id)
+	refreshToken, expiresAt, err := cfg.signRefreshToken(idStr, client.Id, code.scopes...)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	err = cfg.db.AddToken(refreshToken, RefreshToken{
+		Family: randomToken(16),
+		ExpiresAt: expiresAt,
+		UserId: user.Id,
+		CreatedAt: now.UTC(),
+		LastUsedAt: now.UTC(),
+		UserAgent: client.Name,
+		IP: clientIP(r),
+	})
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	idToken := ""
+	if slices.Contains(code.scopes, ScopeOpenID) {
+		claims := idTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer: cfg.publicURL,
+				Subject: idStr,
+				Audience: jwt.ClaimStrings{ client.Id },
+				IssuedAt: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(idTokenLifetime)),
+			},
+			Nonce: code.nonce,
+			AuthTime: jwt.NewNumericDate(code.authTime),
+		}
+		if slices.Contains(code.scopes, ScopeEmail) {
+			claims.Email = user.Email
+			claims.EmailVerified = &user.Verified
+		}
+
+		// RS256 rather than JWT_ALG, it's the one relying parties have to
+		// support
+		idToken, err = cfg.keys.SignedStringWith(jwt.NewWithClaims(jwt.SigningMethodRS256, claims), AlgRS256)
+		if err != nil {
+			respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+	}
+
+	cfg.respondWithOAuthTokens(w, idStr, client.Id, code.scopes, refreshToken, idToken)
+}
+
+func (cfg *apiConfig) exchangeRefreshToken(w http.ResponseWriter, r *http.Request, client OAuthClient) {
+	tok := r.PostForm.Get("refresh_token")
+	claims, err := cfg.parseJWT(tok, "refresh")
+	if err != nil || claims.ClientId != client.Id {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+		return
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+		return
+	}
+
+	refreshToken, expiresAt, err := cfg.signRefreshToken(claims.Subject, client.Id, claims.scopes()...)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	err = cfg.db.RotateToken(tok, refreshToken, RefreshToken{
+		ExpiresAt: expiresAt,
+		UserId: userId,
+		LastUsedAt: cfg.now().UTC(),
+		UserAgent: client.Name,
+		IP: clientIP(r),
+	})
+	if errors.Is(err, ErrTokenReused) {
+		log.Printf("Refresh token reused by OAuth client %s for user %d, revoked its family", client.Id, userId)
+	}
+	if errors.Is(err, ErrTokenReused) || errors.Is(err, ErrRevokedToken) || errors.Is(err, ErrNotExist) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "refresh token has been revoked")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	cfg.respondWithOAuthTokens(w, claims.Subject, client.Id, claims.scopes(), refreshToken, "")
+}
+
+func (cfg *apiConfig) respondWithOAuthTokens(w http.ResponseWriter, userId, clientId string, scopes []string, refreshToken, idToken string) {
+	accessToken, err := cfg.keys.SignedString(forClient(cfg.generateJWT("access", userId, scopes...), clientId))
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			AccessToken string `json:"access_token"`
+			TokenType string `json:"token_type"`
+			ExpiresIn int `json:"expires_in"`
+			RefreshToken string `json:"refresh_token"`
+			Scope string `json:"scope"`
+			IdToken string `json:"id_token,omitempty"`
+		}{
+			AccessToken: accessToken,
+			TokenType: "Bearer",
+			ExpiresIn: int(time.Hour.Seconds()),
+			RefreshToken: refreshToken,
+			Scope: strings.Join(scopes, " "),
+			IdToken: idToken,
+		})
+}
+
+// userinfoHandler is the OIDC userinfo endpoint, for access tokens with the
+// openid scope.
+func (cfg *apiConfig) userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	info, _ := r.Context().Value(authContextKey).(authInfo)
+
+	out := struct{
+		Subject string `json:"sub"`
+		Email string `json:"email,omitempty"`
+		EmailVerified *bool `json:"email_verified,omitempty"`
+	}{
+		Subject: strconv.Itoa(info.user.Id),
+	}
+	if slices.Contains(info.scopes, ScopeEmail) {
+		out.Email = info.user.Email
+		out.EmailVerified = &info.user.Verified
+	}
+	respondWithJSON(w, http.StatusOK, out)
+}
+
+func (cfg *apiConfig) openIDConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			Issuer string `json:"issuer"`
+			AuthorizationEndpoint string `json:"authorization_endpoint"`
+			TokenEndpoint string `json:"token_endpoint"`
+			UserinfoEndpoint string `json:"userinfo_endpoint"`
+			JWKSURI string `json:"jwks_uri"`
+			ScopesSupported []string `json:"scopes_supported"`
+			ResponseTypesSupported []string `json:"response_types_supported"`
+			GrantTypesSupported []string `json:"grant_types_supported"`
+			SubjectTypesSupported []string `json:"subject_types_supported"`
+			IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+			TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+			CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+			ClaimsSupported []string `json:"claims_supported"`
+		}{
+			Issuer: cfg.publicURL,
+			AuthorizationEndpoint: cfg.publicURL + "/oauth/authorize",
+			TokenEndpoint: cfg.publicURL + "/oauth/token",
+			UserinfoEndpoint: cfg.publicURL + "/oauth/userinfo",
+			JWKSURI: cfg.publicURL + "/.well-known/jwks.json",
+			ScopesSupported: oauthScopes,
+			ResponseTypesSupported: []string{ "code" },
+			GrantTypesSupported: []string{ "authorization_code", "refresh_token" },
+			SubjectTypesSupported: []string{ "public" },
+			IdTokenSigningAlgValuesSupported: []string{ AlgRS256 },
+			TokenEndpointAuthMethodsSupported: []string{ "client_secret_basic", "client_secret_post", "none" },
+			CodeChallengeMethodsSupported: []string{ "S256" },
+			ClaimsSupported: []string{ "sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified" },
+		})
+}
+
+type OAuthClientResponse struct {
+	Id string `json:"client_id"`
+	Name string `json:"name"`
+	Confidential bool `json:"confidential"`
+	RedirectURIs []string `json:"redirect_uris"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func oauthClientResponse(client OAuthClient) OAuthClientResponse {
+	return OAuthClientResponse{
+		Id: client.Id,
+		Name: client.Name,
+		Confidential: client.SecretHash != "",
+		RedirectURIs: client.RedirectURIs,
+		CreatedAt: client.CreatedAt,
+	}
+}
+
+// oauthClientPostHandler registers an app. Confidential clients get a secret
+// that's only shown here, public ones like single page apps don't.
+func (cfg *apiConfig) oauthClientPostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool `json:"confidential"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > 100 {
+		respondWithError(w, http.StatusBadRequest, "Name is required and can be at most 100 characters")
+		return
+	}
+	if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxRedirectURIs {
+		respondWithError(w, http.StatusBadRequest, "Between 1 and 10 redirect_uris are required")
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondWithError(w, http.StatusBadRequest,
+				"Invalid redirect uri " + uri + ", it has to be https or http to localhost, with no fragment")
+			return
+		}
+	}
+
+	user, _ := UserFromContext(r.Context())
+	client := OAuthClient{
+		Id: oauthClientPrefix + randomToken(12),
+		UserId: user.Id,
+		Name: name,
+		RedirectURIs: params.RedirectURIs,
+		CreatedAt: cfg.now().UTC(),
+	}
+	secret := ""
+	if params.Confidential {
+		secret = randomToken(32)
+		client.SecretHash = hashToken(secret)
+	}
+
+	err = cfg.db.CreateOAuthClient(client)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated,
+		struct{
+			OAuthClientResponse
+			Secret string `json:"client_secret,omitempty"`
+		}{
+			OAuthClientResponse: oauthClientResponse(client),
+			Secret: secret,
+		})
+}
+
+func (cfg *apiConfig) oauthClientsGetHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	clients, err := cfg.db.GetOAuthClients(user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	out := make([]OAuthClientResponse, len(clients))
+	for i, client := range clients {
+		out[i] = oauthClientResponse(client)
+	}
+	respondWithJSON(w, http.StatusOK, out)
+}
+
+// oauthClientDeleteIdHandler removes a client, after which it can't get or
+// refresh tokens. Access tokens it already has last until they expire.
+func (cfg *apiConfig) oauthClientDeleteIdHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	err := cfg.db.DeleteOAuthClient(user.Id, chi.URLParam(r, "id"))
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "OAuth client not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
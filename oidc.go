@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Users can also log in through external OpenID Connect providers, set up
+// with OIDC_PROVIDERS and OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and
+// optionally _SCOPES. /api/auth/{provider} sends the browser off to the
+// provider, which sends it back to /api/auth/{provider}/callback, where it
+// gets the same tokens as /api/login. The first time, an account is made for
+// the provider's subject. If there's already an account with its email, the
+// owner has to log in and link the provider with POST
+// /api/auth/{provider}/link instead, a provider vouching for an email isn't
+// enough to take over an account. Any OIDC provider works, including another
+// Chirpy.
+
+const (
+	externalLoginLifetime = 10 * time.Minute
+	externalStateCookie = "chirpy_auth_state"
+	// how often an unknown kid can make us fetch the provider's keys again
+	jwksRefetchInterval = time.Minute
+)
+
+var providerName = regexp.MustCompile(`^[a-z0-9]+$`)
+
+var errNoVerifiedEmail = errors.New("the provider didn't give a verified email address")
+var errLinkRequired = errors.New("an account already uses the provider's email")
+var errLinkedElsewhere = errors.New("the provider account is linked to another user")
+
+type oidcProvider struct {
+	name string
+	issuer string
+	clientId string
+	clientSecret string
+	scopes []string
+	client *http.Client
+
+	mu *sync.Mutex
+	// nil until the discovery document has been fetched
+	config *oidcConfig
+	keys map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// oidcConfig is the part of a provider's discovery document we use.
+type oidcConfig struct {
+	Issuer string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+type externalClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce"`
+	Email string `json:"email"`
+	EmailVerified bool `json:"email_verified"`
+}
+
+func oidcProvidersFromEnv() (map[string]*oidcProvider, error) {
+	providers := make(map[string]*oidcProvider)
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		name = strings.ToLower(name)
+		if !providerName.MatchString(name) {
+			return nil, fmt.Errorf("OIDC_PROVIDERS: invalid provider name %q", name)
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			name: name,
+			issuer: os.Getenv(prefix + "ISSUER"),
+			clientId: os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			scopes: strings.Fields(os.Getenv(prefix + "SCOPES")),
+			client: &http.Client{ Timeout: 10 * time.Second },
+			mu: &sync.Mutex{},
+		}
+		if p.issuer == "" || p.clientId == "" {
+			return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+		}
+		if len(p.scopes) == 0 { p.scopes = []string{ ScopeOpenID, ScopeEmail } }
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+// getJSON fetches url into v.
+func (p *oidcProvider) getJSON(url string, v any) error {
+	resp, err := p.client.Get(url)
+	if err != nil { return err }
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(v)
+}
+
+// discover returns the provider's discovery document, fetching it the first
+// time so the server starts even if a provider is down.
+func (p *oidcProvider) discover() (oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil { return *p.config, nil }
+
+	config := oidcConfig{}
+	err := p.getJSON(strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration", &config)
+	if err != nil { return oidcConfig{}, err }
+	if config.Issuer != p.issuer {
+		return oidcConfig{}, fmt.Errorf("provider %s says its issuer is %q", p.name, config.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return oidcConfig{}, fmt.Errorf("provider %s has an incomplete discovery document", p.name)
+	}
+
+	p.config = &config
+	return config, nil
+}
+
+// verificationKey is a jwt.Keyfunc for the provider's id tokens. Keys are
+// fetched again when a token uses one we haven't seen, since that's what
+// happens when the provider rotates.
+func (p *oidcProvider) verificationKey(t *jwt.Token) (interface{}, error) {
+	config, err := p.discover()
+	if err != nil { return nil, err }
+
+	kid, _ := t.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok { return key, nil }
+	if time.Since(p.keysFetchedAt) < jwksRefetchInterval { return nil, ErrUnknownKey }
+
+	jwks := struct{ Keys []JWK `json:"keys"` }{}
+	err = p.getJSON(config.JWKSURI, &jwks)
+	if err != nil { return nil, err }
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysFetchedAt = time.Now()
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" { continue }
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping key from provider %s: %s", p.name, err)
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+
+	if key, ok := p.keys[kid]; ok { return key, nil }
+	return nil, ErrUnknownKey
+}
+
+// exchange swaps a code from the provider for a verified id token.
+func (p *oidcProvider) exchange(code, verifier, redirectURI, nonce string) (externalClaims, error) {
+	config, err := p.discover()
+	if err != nil { return externalClaims{}, err }
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.clientId)
+
+	req, err := http.NewRequest(http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil { return externalClaims{}, err }
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil { return externalClaims{}, err }
+	defer resp.Body.Close()
+
+	body := struct{
+		IdToken string `json:"id_token"`
+		Error string `json:"error"`
+		Description string `json:"error_description"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(&body)
+	if err != nil { return externalClaims{}, fmt.Errorf("token endpoint: %s", resp.Status) }
+	if body.Error != "" { return externalClaims{}, fmt.Errorf("token endpoint: %s: %s", body.Error, body.Description) }
+	if body.IdToken == "" { return externalClaims{}, errors.New("token endpoint didn't return an id token") }
+
+	claims := externalClaims{}
+	_, err = jwt.ParseWithClaims(
+		body.IdToken,
+		&claims,
+		p.verificationKey,
+		jwt.WithValidMethods([]string{ AlgEdDSA, AlgRS256, jwt.SigningMethodES256.Alg() }),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientId),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil { return externalClaims{}, err }
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return externalClaims{}, errors.New("id token nonce doesn't match")
+	}
+	if claims.Subject == "" { return externalClaims{}, errors.New("id token has no subject") }
+	return claims, nil
+}
+
+// pendingLogin is a login sent off to a provider that hasn't come back yet.
+type pendingLogin struct {
+	provider string
+	nonce string
+	verifier string
+	expiresAt time.Time
+	// the user linking the provider to their account, 0 when logging in
+	linkUserId int
+}
+
+// pendingLoginStore keeps pending logins in memory by the hash of their
+// state, like authorization codes.
+type pendingLoginStore struct {
+	mu *sync.Mutex
+	logins map[string]pendingLogin
+}
+
+func newPendingLoginStore() *pendingLoginStore {
+	return &pendingLoginStore{
+		mu: &sync.Mutex{},
+		logins: make(map[string]pendingLogin),
+	}
+}
+
+// add stores a login and returns its state, dropping any that have expired.
+func (s *pendingLoginStore) add(login pendingLogin, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, other := range s.logins {
+		if !now.Before(other.expiresAt) { delete(s.logins, hash) }
+	}
+
+	state := randomToken(32)
+	s.logins[hashToken(state)] = login
+	return state
+}
+
+// take removes a login and returns it, ok is false if it doesn't exist or
+// has expired.
+func (s *pendingLoginStore) take(state string, now time.Time) (pendingLogin, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.logins[hashToken(state)]
+	delete(s.logins, hashToken(state))
+	if !ok || !now.Before(login.expiresAt) { return pendingLogin{}, false }
+	return login, true
+}
+
+func (cfg *apiConfig) externalRedirectURI(provider string) string {
+	return cfg.publicURL + "/api/auth/" + provider + "/callback"
+}
+
+// startExternalLogin sets the state cookie and returns the url to send the
+// browser to at the provider, it responds itself if ok is false.
+func (cfg *apiConfig) startExternalLogin(w http.ResponseWriter, r *http.Request, linkUserId int) (string, bool) {
+	p, ok := cfg.providers[chi.URLParam(r, "provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider")
+		return "", false
+	}
+
+	config, err := p.discover()
+	if err != nil {
+		log.Printf("Error discovering login provider %s: %s", p.name, err)
+		respondWithError(w, http.StatusBadGateway, "Couldn't reach the login provider")
+		return "", false
+	}
+
+	now := cfg.now()
+	login := pendingLogin{
+		provider: p.name,
+		nonce: randomToken(16),
+		verifier: randomToken(32),
+		expiresAt: now.Add(externalLoginLifetime),
+		linkUserId: linkUserId,
+	}
+	state := cfg.pendingLogins.add(login, now)
+
+	// the state is also kept in a cookie so a callback only works in the
+	// browser that started the login
+	http.SetCookie(w, &http.Cookie{
+		Name: externalStateCookie,
+		Value: state,
+		Path: "/api/auth/",
+		MaxAge: int(externalLoginLifetime.Seconds()),
+		HttpOnly: true,
+		Secure: strings.HasPrefix(cfg.publicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	sum := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientId)
+	query.Set("redirect_uri", cfg.externalRedirectURI(p.name))
+	query.Set("scope", strings.Join(p.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", login.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	query.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") { sep = "&" }
+	return config.AuthorizationEndpoint + sep + query.Encode(), true
+}
+
+// externalLoginHandler sends the browser to the provider to log in.
+func (cfg *apiConfig) externalLoginHandler(w http.ResponseWriter, r *http.Request) {
+	location, ok := cfg.startExternalLogin(w, r, 0)
+	if !ok { return }
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// externalLinkPostHandler starts linking a provider to the logged in user's
+// account. It can't redirect since it's called with an access token rather
+// than by the browser, so it responds with the url to send the browser to.
+// A new way to log in needs the current password, and a code if 2FA is on,
+// so a stolen access token can't be turned into a login of its own.
+func (cfg *apiConfig) externalLinkPostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+	problems := []ValidationError{}
+	if params.CurrentPassword == "" {
+		problems = append(problems, ValidationError{
+			Field: "current_password", Code: "required",
+			Message: "Your current password is needed to link a login provider",
+		})
+	}
+	if user.TOTP.Enabled && params.Code == "" && params.RecoveryCode == "" {
+		problems = append(problems, ValidationError{
+			Field: "code", Code: "required",
+			Message: "A code from your authenticator app is needed to link a login provider",
+		})
+	}
+	if len(problems) > 0 {
+		respondWithValidationErrors(w, problems)
+		return
+	}
+
+	if !cfg.confirmPassword(w, r, user, params.CurrentPassword) { return }
+	if user.TOTP.Enabled {
+		err = cfg.verifySecondFactor(user, params.Code, params.RecoveryCode)
+		if err != nil {
+			cfg.limiter.fail(loginKeys(user.Email, r), cfg.now())
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+	cfg.limiter.clear(lockoutAccount, normalizeEmail(user.Email))
+
+	location, ok := cfg.startExternalLogin(w, r, user.Id)
+	if !ok { return }
+
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			URL string `json:"url"`
+		}{
+			URL: location,
+		})
+}
+
+// externalCallbackHandler is where the provider sends the browser back to.
+func (cfg *apiConfig) externalCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := cfg.providers[chi.URLParam(r, "provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	query := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{ Name: externalStateCookie, Path: "/api/auth/", MaxAge: -1 })
+
+	cookie, err := r.Cookie(externalStateCookie)
+	state := query.Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Login state doesn't match, start again")
+		return
+	}
+	login, ok := cfg.pendingLogins.take(state, cfg.now())
+	if !ok || login.provider != p.name {
+		respondWithError(w, http.StatusUnauthorized, "Login expired, start again")
+		return
+	}
+
+	if e := query.Get("error"); e != "" {
+		respondWithError(w, http.StatusUnauthorized, "The login provider refused: " + e)
+		return
+	}
+
+	claims, err := p.exchange(query.Get("code"), login.verifier, cfg.externalRedirectURI(p.name), login.nonce)
+	if err != nil {
+		log.Printf("Error finishing login with provider %s: %s", p.name, err)
+		respondWithError(w, http.StatusUnauthorized, "Couldn't log in with the provider")
+		return
+	}
+
+	user, err := cfg.userForIdentity(p.name, claims, login.linkUserId)
+	if errors.Is(err, errNoVerifiedEmail) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, errLinkRequired) {
+		respondWithError(w, http.StatusConflict,
+			"An account already uses this email, log in with your password and link the provider from there")
+		return
+	}
+	if errors.Is(err, errLinkedElsewhere) {
+		respondWithError(w, http.StatusConflict, "This provider account is already linked to another user")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if user.TOTP.Enabled {
+		cfg.respondWithMFAChallenge(w, user)
+		return
+	}
+	cfg.completeLogin(w, r, user)
+}
+
+// userForIdentity returns the user a provider's subject is linked to. A new
+// subject is linked to linkUserId if that's set, otherwise an account is
+// made for it, as long as its email is verified and no one has it yet.
+func (cfg *apiConfig) userForIdentity(provider string, claims externalClaims, linkUserId int) (User, error) {
+	identity, err := cfg.db.GetIdentity(provider, claims.Subject)
+	if err == nil {
+		if linkUserId != 0 && identity.UserId != linkUserId { return User{}, errLinkedElsewhere }
+		return cfg.db.GetUserFromId(identity.UserId)
+	}
+	if !errors.Is(err, ErrNotExist) { return User{}, err }
+
+	var user User
+	if linkUserId != 0 {
+		user, err = cfg.db.GetUserFromId(linkUserId)
+		if err != nil { return User{}, err }
+	} else {
+		if !claims.EmailVerified || !validEmail(claims.Email) { return User{}, errNoVerifiedEmail }
+
+		_, err = cfg.db.GetUserFromEmail(claims.Email)
+		if err == nil { return User{}, errLinkRequired }
+		if !errors.Is(err, ErrNotExist) { return User{}, err }
+
+		// a password nobody knows, it can be set with a password reset
+		encPass, err := cfg.hasher.Hash(randomToken(32))
+		if err != nil { return User{}, err }
+
+		user, err = cfg.db.CreateUser(claims.Email, encPass)
+		if err != nil { return User{}, err }
+		err = cfg.db.VerifyUser(user.Id)
+		if err != nil { return User{}, err }
+		user.Verified = true
+		log.Printf("Created user %d for %s login", user.Id, provider)
+	}
+
+	err = cfg.db.CreateIdentity(Identity{
+		Provider: provider,
+		Subject: claims.Subject,
+		UserId: user.Id,
+		Email: claims.Email,
+		CreatedAt: cfg.now().UTC(),
+	})
+	if err != nil { return User{}, err }
+
+	return user, nil
+}
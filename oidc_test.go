@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testProvider stands in for an OIDC provider. It skips the login page,
+// tests say who logs in by handing it the claims for a code.
+type testProvider struct {
+	*httptest.Server
+	keys *KeySet
+	mu *sync.Mutex
+	codes map[string]externalClaims
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	keys, err := LoadKeySet(filepath.Join(t.TempDir(), "idp_keys.json"), AlgEdDSA, 0)
+	if err != nil { t.Fatal(err) }
+	p := &testProvider{ keys: keys, mu: &sync.Mutex{}, codes: make(map[string]externalClaims) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, oidcConfig{
+			Issuer: p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint: p.URL + "/token",
+			JWKSURI: p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, struct{ Keys []JWK `json:"keys"` }{ Keys: p.keys.JWKS() })
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		claims, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		if !ok {
+			respondWithJSON(w, http.StatusBadRequest, struct{ Error string `json:"error"` }{ Error: "invalid_grant" })
+			return
+		}
+
+		idToken, err := p.keys.SignedString(jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims))
+		if err != nil { t.Error(err) }
+		respondWithJSON(w, http.StatusOK, struct{ IdToken string `json:"id_token"` }{ IdToken: idToken })
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// oidcTestServer is a config using the stand-in provider as "idp", and a
+// router with the routes external logins use.
+func oidcTestServer(t *testing.T) (*apiConfig, *testProvider, http.Handler) {
+	now := time.Now()
+	cfg := testConfig(t, &now)
+	provider := newTestProvider(t)
+	cfg.publicURL = "http://chirpy.test"
+	cfg.pendingLogins = newPendingLoginStore()
+	cfg.providers = map[string]*oidcProvider{
+		"idp": {
+			name: "idp",
+			issuer: provider.URL,
+			clientId: "chirpy",
+			scopes: []string{ ScopeOpenID, ScopeEmail },
+			client: provider.Client(),
+			mu: &sync.Mutex{},
+		},
+	}
+
+	r := chi.NewRouter()
+	r.Get("/api/auth/{provider}", cfg.externalLoginHandler)
+	r.Get("/api/auth/{provider}/callback", cfg.externalCallbackHandler)
+	r.With(cfg.middlewareAuth, cfg.requireScope(ScopeAccountWrite)).Post("/api/auth/{provider}/link", cfg.externalLinkPostHandler)
+	return cfg, provider, r
+}
+
+// startLink asks to link the provider to whoever accessToken belongs to.
+func startLink(router http.Handler, accessToken, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/idp/link", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer " + accessToken)
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// externalLogin goes through a login at the provider as sub with email, or
+// links sub to whoever accessToken belongs to if it's set, and returns the
+// callback's response.
+func externalLogin(t *testing.T, provider *testProvider, router http.Handler, sub, email, accessToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	location := ""
+	if accessToken == "" {
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/idp", nil))
+		location = w.Header().Get("Location")
+	} else {
+		w = startLink(router, accessToken, `{"current_password":"password"}`)
+		resp := struct{ URL string `json:"url"` }{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		location = resp.URL
+	}
+	if location == "" { t.Fatalf("starting the login got %d: %s", w.Code, w.Body) }
+
+	u, err := url.Parse(location)
+	if err != nil { t.Fatal(err) }
+	query := u.Query()
+
+	code := randomToken(16)
+	provider.mu.Lock()
+	provider.codes[code] = externalClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: provider.URL,
+			Subject: sub,
+			Audience: jwt.ClaimStrings{ query.Get("client_id") },
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Nonce: query.Get("nonce"),
+		Email: email,
+		EmailVerified: true,
+	}
+	provider.mu.Unlock()
+
+	callback := httptest.NewRequest(http.MethodGet,
+		"/api/auth/idp/callback?" + url.Values{ "state": { query.Get("state") }, "code": { code } }.Encode(), nil)
+	for _, cookie := range w.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, callback)
+	return w
+}
+
+func loggedInAs(t *testing.T, w *httptest.ResponseRecorder) int {
+	t.Helper()
+	if w.Code != http.StatusOK { t.Fatalf("login got %d: %s", w.Code, w.Body) }
+	resp := struct{ Id int `json:"id"` }{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil { t.Fatal(err) }
+	return resp.Id
+}
+
+func TestExternalLoginCreatesAccount(t *testing.T) {
+	cfg, provider, router := oidcTestServer(t)
+
+	id := loggedInAs(t, externalLogin(t, provider, router, "sub-1", "new@b.c", ""))
+	user, err := cfg.db.GetUserFromEmail("new@b.c")
+	if err != nil { t.Fatalf("no account was made: %s", err) }
+	if user.Id != id || !user.Verified { t.Fatalf("made %+v, logged in as %d", user, id) }
+
+	// the subject is what's linked, so a changed email still logs in
+	if again := loggedInAs(t, externalLogin(t, provider, router, "sub-1", "renamed@b.c", "")); again != id {
+		t.Fatalf("second login was as %d, want %d", again, id)
+	}
+}
+
+// TestExternalLoginDoesntTakeOverAccounts checks a provider that says a
+// local account's email is verified can't be used to log in to it.
+func TestExternalLoginDoesntTakeOverAccounts(t *testing.T) {
+	cfg, provider, router := oidcTestServer(t)
+	hash, err := cfg.hasher.Hash("password")
+	if err != nil { t.Fatal(err) }
+	admin, err := cfg.db.CreateUser("admin@b.c", hash)
+	if err != nil { t.Fatal(err) }
+	if err := cfg.db.VerifyUser(admin.Id); err != nil { t.Fatal(err) }
+	if err := cfg.db.SetUserRole(admin.Id, RoleAdmin); err != nil { t.Fatal(err) }
+
+	w := externalLogin(t, provider, router, "attacker", "admin@b.c", "")
+	if w.Code != http.StatusConflict { t.Fatalf("login with an existing account's email got %d, want 409: %s", w.Code, w.Body) }
+	if _, err := cfg.db.GetIdentity("idp", "attacker"); err != ErrNotExist {
+		t.Fatalf("the provider account was linked anyway: %v", err)
+	}
+
+	// the owner can link it themselves once they've logged in
+	accessToken, err := cfg.keys.SignedString(cfg.generateJWT("access", strconv.Itoa(admin.Id), allScopes...))
+	if err != nil { t.Fatal(err) }
+	if id := loggedInAs(t, externalLogin(t, provider, router, "admin-sub", "admin@b.c", accessToken)); id != admin.Id {
+		t.Fatalf("linking logged in as %d, want %d", id, admin.Id)
+	}
+	if id := loggedInAs(t, externalLogin(t, provider, router, "admin-sub", "admin@b.c", "")); id != admin.Id {
+		t.Fatalf("login after linking was as %d, want %d", id, admin.Id)
+	}
+
+	// and a subject linked to someone else can't be moved to them
+	other, err := cfg.db.CreateUser("other@b.c", hash)
+	if err != nil { t.Fatal(err) }
+	otherToken, err := cfg.keys.SignedString(cfg.generateJWT("access", strconv.Itoa(other.Id), allScopes...))
+	if err != nil { t.Fatal(err) }
+	if w := externalLogin(t, provider, router, "admin-sub", "admin@b.c", otherToken); w.Code != http.StatusConflict {
+		t.Fatalf("linking another user's subject got %d, want 409: %s", w.Code, w.Body)
+	}
+}
+
+// TestLinkNeedsReauthentication checks an access token alone isn't enough to
+// add a provider login to an account.
+func TestLinkNeedsReauthentication(t *testing.T) {
+	cfg, _, router := oidcTestServer(t)
+	hash, err := cfg.hasher.Hash("password")
+	if err != nil { t.Fatal(err) }
+	user, err := cfg.db.CreateUser("a@b.c", hash)
+	if err != nil { t.Fatal(err) }
+	accessToken, err := cfg.keys.SignedString(cfg.generateJWT("access", strconv.Itoa(user.Id), allScopes...))
+	if err != nil { t.Fatal(err) }
+
+	if w := startLink(router, accessToken, `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("linking without a password got %d, want 400", w.Code)
+	}
+	if w := startLink(router, accessToken, `{"current_password":"wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("linking with the wrong password got %d, want 401", w.Code)
+	}
+
+	if err := cfg.db.SetUserTOTP(user.Id, TOTP{ Secret: rfcSecret, Enabled: true }); err != nil { t.Fatal(err) }
+	if w := startLink(router, accessToken, `{"current_password":"password"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("linking without a code with 2FA on got %d, want 400", w.Code)
+	}
+	if w := startLink(router, accessToken, `{"current_password":"password","code":"000000"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("linking with a wrong code got %d, want 401", w.Code)
+	}
+	code, err := totpCode(rfcSecret, totpStep(cfg.now()))
+	if err != nil { t.Fatal(err) }
+	if w := startLink(router, accessToken, `{"current_password":"password","code":"` + code + `"}`); w.Code != http.StatusOK {
+		t.Fatalf("linking with the password and a code got %d: %s", w.Code, w.Body)
+	}
+}
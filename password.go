@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const purposePasswordReset = "password_reset"
+const passwordResetLifetime = time.Hour
+
+// sendOneTimeToken stores a new token for the user and mails it to them as a
+// link to path on the public site.
+func (cfg *apiConfig) sendOneTimeToken(user User, purpose string, lifetime time.Duration, path, subject, text string) error {
+	token := randomToken(32)
+	err := cfg.db.CreateOneTimeToken(hashToken(token), OneTimeToken{
+		Purpose: purpose,
+		UserId: user.Id,
+		Email: user.Email,
+		ExpiresAt: cfg.now().Add(lifetime),
+	})
+	if err != nil { return err }
+
+	link := cfg.publicURL + path + "?" + url.Values{ "token": { token } }.Encode()
+	return cfg.mailer.Send(Mail{
+		To: user.Email,
+		Subject: subject,
+		Body: fmt.Sprintf("%s\n\n%s\n\nThe link expires in %s.", text, link, lifetime),
+	})
+}
+
+// passwordForgotPostHandler mails a reset link if the email belongs to a
+// user. It answers the same way either way, and mails in the background so
+// the time taken doesn't give it away.
+func (cfg *apiConfig) passwordForgotPostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.db.GetUserFromEmail(params.Email)
+	if err == nil {
+		go func() {
+			err := cfg.sendOneTimeToken(user, purposePasswordReset, passwordResetLifetime,
+				"/app/reset-password/", "Reset your Chirpy password",
+				"Someone asked to reset the password for your Chirpy account. If it was you, follow this link to choose a new one:")
+			if err != nil { log.Printf("Error sending password reset to user %d: %s", user.Id, err) }
+		}()
+	} else if !errors.Is(err, ErrNotExist) {
+		log.Printf("Error looking up user for password reset: %s", err)
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// passwordResetPostHandler sets a new password with a token from a reset
+// link, and logs the user out everywhere in case someone else had it.
+func (cfg *apiConfig) passwordResetPostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	// checked before the token is used up, then again with the email below
+	if problems := cfg.policy.Check(params.Password, ""); len(problems) > 0 {
+		respondWithValidationErrors(w, problems)
+		return
+	}
+
+	token, err := cfg.db.ConsumeOneTimeToken(hashToken(params.Token), purposePasswordReset, cfg.now())
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// a link sent to an address the user has since moved away from could be
+	// read by whoever has that address now
+	user, err := cfg.db.GetUserFromId(token.UserId)
+	if errors.Is(err, ErrNotExist) || (err == nil && normalizeEmail(user.Email) != normalizeEmail(token.Email)) {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if problems := cfg.policy.Check(params.Password, user.Email); len(problems) > 0 {
+		// put the token back so the link still works for another try
+		err = cfg.db.CreateOneTimeToken(hashToken(params.Token), token)
+		if err != nil { log.Printf("Error restoring reset token: %s", err) }
+		respondWithValidationErrors(w, problems)
+		return
+	}
+
+	encPass, err := cfg.hasher.Hash(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cfg.db.SetUserPassword(user.Id, encPass)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, err = cfg.db.RevokeSessions(user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
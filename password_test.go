@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestResetTokenBoundToEmail checks a reset link stops working once the
+// user changes their email, since it was sent to the old one.
+func TestResetTokenBoundToEmail(t *testing.T) {
+	now := time.Now()
+	cfg := testConfig(t, &now)
+	mailer := &testMailer{}
+	cfg.mailer = mailer
+	cfg.publicURL = "http://chirpy.test"
+	cfg.policy = &PasswordPolicy{ minLength: 1, maxLength: defaultPasswordMaxLength, banned: map[string]bool{} }
+
+	reset := func(token string) int {
+		w := httptest.NewRecorder()
+		body := `{"token":"` + token + `","password":"new password"}`
+		cfg.passwordResetPostHandler(w, httptest.NewRequest(http.MethodPost, "/api/password/reset", strings.NewReader(body)))
+		return w.Code
+	}
+
+	user, err := cfg.db.CreateUser("old@b.c", "hash")
+	if err != nil { t.Fatal(err) }
+	err = cfg.sendOneTimeToken(user, purposePasswordReset, time.Hour, "/app/reset-password/", "", "")
+	if err != nil { t.Fatal(err) }
+	token, err := url.QueryUnescape(mailedToken.FindStringSubmatch(mailer.sent[0].Body)[1])
+	if err != nil { t.Fatal(err) }
+
+	if _, err := cfg.db.UpdateUser(user.Id, "new@b.c", ""); err != nil { t.Fatal(err) }
+	if status := reset(token); status != http.StatusUnauthorized {
+		t.Fatalf("token sent to the old address got %d, want 401", status)
+	}
+	if user, _ := cfg.db.GetUserFromId(user.Id); user.Password != "hash" { t.Fatal("password was reset by the old token") }
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// New passwords have to meet a policy: a length range, a rough entropy
+// estimate, not being a common or banned password or too close to the email,
+// and not showing up in a list of breached passwords if one is configured.
+// The settings come from PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH,
+// PASSWORD_MIN_ENTROPY, PASSWORD_BANNED_FILE and PASSWORD_BREACHED_FILE.
+
+const (
+	defaultPasswordMinLength = 8
+	// long enough for any passphrase, short enough for bcrypt
+	defaultPasswordMaxLength = 64
+	// bcrypt refuses anything longer, and the max length is in characters
+	// which can take up to 4 bytes each
+	maxPasswordBytes = 72
+	defaultPasswordMinEntropy = 40
+)
+
+// commonPasswords are always banned, PASSWORD_BANNED_FILE adds to them.
+var commonPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "password", "password1",
+	"password123", "qwerty", "qwerty123", "qwertyuiop", "abc123", "111111",
+	"123123", "iloveyou", "admin", "admin123", "welcome", "welcome1",
+	"letmein", "monkey", "dragon", "football", "baseball", "sunshine",
+	"princess", "starwars", "trustno1", "passw0rd", "p@ssw0rd", "changeme",
+	"chirpy", "chirpy123",
+}
+
+// ValidationError is one thing wrong with a request's parameters, with a
+// code for clients to act on and a message to show.
+type ValidationError struct {
+	Field string `json:"field"`
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+type PasswordPolicy struct {
+	minLength int
+	maxLength int
+	// in bits, see passwordEntropy
+	minEntropy float64
+	// lower cased
+	banned map[string]bool
+	breached *breachedList
+}
+
+func passwordPolicyFromEnv() (*PasswordPolicy, error) {
+	p := &PasswordPolicy{ banned: make(map[string]bool) }
+
+	minLength, err := uintFromEnv("PASSWORD_MIN_LENGTH", defaultPasswordMinLength, 16)
+	if err != nil { return nil, err }
+	maxLength, err := uintFromEnv("PASSWORD_MAX_LENGTH", defaultPasswordMaxLength, 16)
+	if err != nil { return nil, err }
+	minEntropy, err := uintFromEnv("PASSWORD_MIN_ENTROPY", defaultPasswordMinEntropy, 16)
+	if err != nil { return nil, err }
+	p.minLength, p.maxLength, p.minEntropy = int(minLength), int(maxLength), float64(minEntropy)
+
+	if p.minLength < 1 || p.maxLength < p.minLength {
+		return nil, fmt.Errorf("password length limits %d to %d make no sense", p.minLength, p.maxLength)
+	}
+	if p.maxLength > maxPasswordBytes {
+		return nil, fmt.Errorf("PASSWORD_MAX_LENGTH can't be more than %d", maxPasswordBytes)
+	}
+
+	for _, password := range commonPasswords {
+		p.banned[password] = true
+	}
+	if path := os.Getenv("PASSWORD_BANNED_FILE"); path != "" {
+		err := p.loadBanned(path)
+		if err != nil { return nil, fmt.Errorf("PASSWORD_BANNED_FILE: %w", err) }
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_FILE"); path != "" {
+		_, err := os.Stat(path)
+		if err != nil { return nil, fmt.Errorf("PASSWORD_BREACHED_FILE: %w", err) }
+		p.breached = &breachedList{ path: path }
+	}
+	return p, nil
+}
+
+// loadBanned reads a file with one banned password per line.
+func (p *PasswordPolicy) loadBanned(path string) error {
+	f, err := os.Open(path)
+	if err != nil { return err }
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.banned[strings.ToLower(line)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Check returns everything wrong with password for the user with email, or
+// nothing if it's fine.
+func (p *PasswordPolicy) Check(password, email string) []ValidationError {
+	problems := []ValidationError{}
+	add := func(code, message string) {
+		problems = append(problems, ValidationError{ Field: "password", Code: code, Message: message })
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.minLength {
+		add("too_short", fmt.Sprintf("Password must be at least %d characters", p.minLength))
+	}
+	if length > p.maxLength {
+		add("too_long", fmt.Sprintf("Password can be at most %d characters", p.maxLength))
+	} else if len(password) > maxPasswordBytes {
+		add("too_long", fmt.Sprintf("Password is too long, accented letters and symbols count as more than one character towards the limit of %d", maxPasswordBytes))
+	}
+	// the rest would only pile on for an empty password
+	if length == 0 { return problems }
+
+	lower := strings.ToLower(password)
+	if p.banned[lower] {
+		add("banned", "Password is too common")
+	} else if passwordEntropy(password) < p.minEntropy {
+		add("too_weak", "Password is too easy to guess, try a longer one or mix in other kinds of characters")
+	}
+
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if email != "" && (lower == strings.ToLower(email) || (len(local) >= 4 && strings.Contains(lower, local))) {
+		add("contains_email", "Password can't contain your email address")
+	}
+
+	if p.breached != nil && len(problems) == 0 {
+		found, err := p.breached.contains(password)
+		if err != nil {
+			// better to let a password through than to stop everyone
+			// signing up because the file went missing
+			log.Printf("Error checking breached passwords: %s", err)
+		} else if found {
+			add("breached", "Password has appeared in a data breach, choose another")
+		}
+	}
+	return problems
+}
+
+// passwordEntropy is a rough estimate in bits: the log of the size of the
+// character classes used, times the length, with characters that repeat
+// or continue a run like "abc" or "321" only counting half.
+func passwordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower { pool += 26 }
+	if upper { pool += 26 }
+	if digit { pool += 10 }
+	if symbol { pool += 33 }
+	if other { pool += 100 }
+
+	length := 0.0
+	var prev rune = -1
+	var step rune
+	for _, r := range password {
+		d := r - prev
+		switch {
+		case prev == -1:
+			length++
+		case d == 0 || ((d == 1 || d == -1) && d == step):
+			length += 0.5
+		default:
+			length++
+		}
+		if prev != -1 { step = d }
+		prev = r
+	}
+	return length * math.Log2(float64(pool))
+}
+
+// breachedList looks passwords up in a file of SHA-1 hashes of breached
+// passwords, one "HASH:COUNT" line each sorted by hash, which is how Have I
+// Been Pwned publishes them. The file is far too big to load, so it's binary
+// searched for the range of hashes sharing the password's 5 character
+// prefix like the k-anonymity api, then that range is scanned.
+type breachedList struct {
+	path string
+}
+
+func (b *breachedList) contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix := hash[:5]
+
+	f, err := os.Open(b.path)
+	if err != nil { return false, err }
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil { return false, err }
+	size := info.Size()
+
+	// find where the first line at or after the prefix starts
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi - lo) / 2
+		line, err := lineAt(f, mid, size)
+		if err != nil { return false, err }
+		if line == "" || strings.ToUpper(line) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	start, err := lineStart(f, lo, size)
+	if err != nil { return false, err }
+	scanner := bufio.NewScanner(io.NewSectionReader(f, start, size - start))
+	for scanner.Scan() {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if !strings.HasPrefix(line, prefix) { break }
+		if strings.HasPrefix(line, hash) { return true, nil }
+	}
+	return false, scanner.Err()
+}
+
+// lineStart is the offset of the first line that starts at or after off.
+func lineStart(f *os.File, off, size int64) (int64, error) {
+	if off == 0 { return 0, nil }
+
+	r := bufio.NewReader(io.NewSectionReader(f, off - 1, size - off + 1))
+	skipped, err := r.ReadString('\n')
+	if err == io.EOF { return size, nil }
+	if err != nil { return 0, err }
+	return off - 1 + int64(len(skipped)), nil
+}
+
+// lineAt returns the first line that starts at or after off, or "" if there
+// isn't one.
+func lineAt(f *os.File, off, size int64) (string, error) {
+	start, err := lineStart(f, off, size)
+	if err != nil || start >= size { return "", err }
+
+	r := bufio.NewReader(io.NewSectionReader(f, start, size - start))
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF { return "", err }
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestPasswordPolicyFitsBcrypt checks anything the policy lets through can
+// be hashed, including passwords under the character limit that are over
+// bcrypt's 72 bytes.
+func TestPasswordPolicyFitsBcrypt(t *testing.T) {
+	policy := &PasswordPolicy{
+		minLength: 1,
+		maxLength: defaultPasswordMaxLength,
+		banned: map[string]bool{},
+	}
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil { t.Fatal(err) }
+
+	for _, password := range []string{
+		strings.Repeat("a", 64),
+		strings.Repeat("é", 36),
+		strings.Repeat("é", 37),
+		strings.Repeat("水", 24),
+		strings.Repeat("水", 25),
+		strings.Repeat("🐦", 18),
+		strings.Repeat("🐦", 19),
+	} {
+		problems := policy.Check(password, "")
+		_, err := hasher.Hash(password)
+		if len(problems) == 0 && err != nil {
+			t.Errorf("%d byte password passed the policy but couldn't be hashed: %s", len(password), err)
+		}
+		if len(problems) > 0 && len(password) <= maxPasswordBytes {
+			t.Errorf("%d byte password was refused: %+v", len(password), problems)
+		}
+	}
+}
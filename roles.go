@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Roles are ranked, each one can do everything the ones below it can.
+// Moderators can delete anyone's chirps, admins can also use the admin
+// endpoints and hand out roles.
+const (
+	RoleUser = "user"
+	RoleModerator = "moderator"
+	RoleAdmin = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser: 1,
+	RoleModerator: 2,
+	RoleAdmin: 3,
+}
+
+// Scopes limit what a token or api key can be used for, on top of what its
+// user's role allows. Tokens from logging in carry all of them.
+const (
+	ScopeChirpsRead = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	ScopeAccountRead = "account:read"
+	ScopeAccountWrite = "account:write"
+	ScopeAdmin = "admin"
+)
+
+var allScopes = []string{
+	ScopeChirpsRead,
+	ScopeChirpsWrite,
+	ScopeAccountRead,
+	ScopeAccountWrite,
+	ScopeAdmin,
+}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// hasRole reports whether the user's role is at least role.
+func (user User) hasRole(role string) bool {
+	return roleRanks[user.Role] >= roleRanks[role]
+}
+
+// requireRole only lets through users with at least role. It has to run
+// after middlewareAuth.
+func (cfg *apiConfig) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				respondWithError(w, http.StatusUnauthorized, "Authorization header not included")
+				return
+			}
+			if !user.hasRole(role) {
+				respondWithError(w, http.StatusForbidden, fmt.Sprintf("Requires the %s role", role))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireScope rejects authenticated requests whose token doesn't carry
+// scope. Anonymous requests are left to the auth middleware in front of it.
+func (cfg *apiConfig) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, ok := r.Context().Value(authContextKey).(authInfo)
+			if ok && !slices.Contains(info.scopes, scope) {
+				respondWithError(w, http.StatusForbidden, fmt.Sprintf("Token lacks the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireFirstParty keeps tokens issued to OAuth clients away from routes
+// that hand out new credentials, like api keys, which would outlive the
+// client's grant being revoked. It has to run after the auth middleware.
+func (cfg *apiConfig) requireFirstParty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := r.Context().Value(authContextKey).(authInfo)
+		if ok && info.clientId != "" {
+			respondWithError(w, http.StatusForbidden, "Apps can't do this on your behalf, log in to Chirpy directly")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cfg *apiConfig) userRolePutHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if !validRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown role %q", params.Role))
+		return
+	}
+
+	// an admin demoting themselves could leave nobody able to undo it
+	user, _ := UserFromContext(r.Context())
+	if user.Id == id && params.Role != RoleAdmin {
+		respondWithError(w, http.StatusBadRequest, "Admins can't demote themselves")
+		return
+	}
+
+	err = cfg.db.SetUserRole(id, params.Role)
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "No such user")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			Id int `json:"id"`
+			Role string `json:"role"`
+		}{
+			Id: id,
+			Role: params.Role,
+		})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestClientTokensCantMintCredentials checks a token issued to an OAuth
+// client with account:write can't make an api key, which would keep working
+// after the client is revoked.
+func TestClientTokensCantMintCredentials(t *testing.T) {
+	now := time.Now()
+	cfg := testConfig(t, &now)
+	user, err := cfg.db.CreateUser("a@b.c", "hash")
+	if err != nil { t.Fatal(err) }
+
+	r := chi.NewRouter()
+	r.With(cfg.middlewareAuth, cfg.requireScope(ScopeAccountWrite), cfg.requireFirstParty).Post("/api/apikeys", cfg.apiKeyPostHandler)
+	createKey := func(accessToken string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/apikeys",
+			strings.NewReader(`{"name":"k","scopes":["chirps:read"],"expires_in":3600}`))
+		req.Header.Set("Authorization", "Bearer " + accessToken)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	id := strconv.Itoa(user.Id)
+	clientToken, err := cfg.keys.SignedString(forClient(cfg.generateJWT("access", id, oauthScopes...), "some-client"))
+	if err != nil { t.Fatal(err) }
+	if status := createKey(clientToken); status != http.StatusForbidden {
+		t.Fatalf("client token creating an api key got %d, want 403", status)
+	}
+
+	ownToken, err := cfg.keys.SignedString(cfg.generateJWT("access", id, allScopes...))
+	if err != nil { t.Fatal(err) }
+	if status := createKey(ownToken); status != http.StatusCreated {
+		t.Fatalf("user's own token creating an api key got %d", status)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (cfg *apiConfig) sessionsGetHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+
+	sessions, err := cfg.db.GetSessions(user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) sessionDeleteIdHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+
+	err := cfg.db.RevokeSession(user.Id, chi.URLParam(r, "id"))
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "No such session")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// sessionsDeleteHandler logs the user out everywhere.
+func (cfg *apiConfig) sessionsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+
+	n, err := cfg.db.RevokeSessions(user.Id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			Revoked int `json:"revoked"`
+		}{
+			Revoked: n,
+		})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Snapshots are gzipped copies of the json database state, each with a
+// sha256sum style checksum file next to it. Automatic ones are pruned by the
+// retention rules, ones taken by hand are only ever removed by hand.
+
+const snapshotExt = ".json.gz"
+const checksumExt = ".sha256"
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+const (
+	snapshotAuto = "auto"
+	snapshotManual = "manual"
+)
+
+var ErrBadChecksum = errors.New("snapshot checksum does not match")
+
+// Snapshotter is implemented by stores that can write out a consistent copy
+// of all their data.
+type Snapshotter interface {
+	WriteSnapshot(w io.Writer) error
+}
+
+type SnapshotInfo struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+	Size int64 `json:"size"`
+	Checksum string `json:"sha256"`
+}
+
+type SnapshotManager struct {
+	dir string
+	source Snapshotter
+	// retention for automatic snapshots, zero means no limit
+	keep int
+	maxAge time.Duration
+}
+
+func NewSnapshotManager(dir string, source Snapshotter, keep int, maxAge time.Duration) *SnapshotManager {
+	return &SnapshotManager{
+		dir: dir,
+		source: source,
+		keep: keep,
+		maxAge: maxAge,
+	}
+}
+
+// WriteSnapshot writes the state as it is at the time of the call, in the
+// same format as the database file so it's encrypted if that is.
+func (db *DB) WriteSnapshot(w io.Writer) error {
+	db.mu.RLock()
+	dat, err := json.Marshal(db.state)
+	db.mu.RUnlock()
+	if err != nil { return err }
+
+	dat, err = db.opts.Keys.sealSnapshot(dat)
+	if err != nil { return err }
+
+	_, err = w.Write(dat)
+	return err
+}
+
+// fileSnapshotSource snapshots a json database straight from its files, for
+// when it's open in another process.
+type fileSnapshotSource struct {
+	path string
+	keys *KeyRing
+}
+
+func (src fileSnapshotSource) WriteSnapshot(w io.Writer) error {
+	db := &DB{ path: src.path, opts: DBOptions{ Keys: src.keys } }
+	dbs, _, err := db.readState()
+	if err != nil { return err }
+
+	dat, err := json.Marshal(dbs)
+	if err != nil { return err }
+
+	dat, err = src.keys.sealSnapshot(dat)
+	if err != nil { return err }
+
+	_, err = w.Write(dat)
+	return err
+}
+
+func (m *SnapshotManager) Create(kind string) (SnapshotInfo, error) {
+	err := os.MkdirAll(m.dir, 0700)
+	if err != nil { return SnapshotInfo{}, err }
+
+	now := time.Now().UTC()
+	name := kind + "-" + now.Format(snapshotTimeFormat) + snapshotExt
+	path := filepath.Join(m.dir, name)
+
+	tmp, err := os.CreateTemp(m.dir, ".snapshot-*")
+	if err != nil { return SnapshotInfo{}, err }
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	counter := &countingWriter{ w: io.MultiWriter(tmp, hash) }
+	gz := gzip.NewWriter(counter)
+
+	err = m.source.WriteSnapshot(gz)
+	if err == nil { err = gz.Close() }
+	if err == nil { err = tmp.Sync() }
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	if err != nil { return SnapshotInfo{}, err }
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	err = os.WriteFile(path + checksumExt, []byte(sum + "  " + name + "\n"), 0600)
+	if err != nil { return SnapshotInfo{}, err }
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil { return SnapshotInfo{}, err }
+
+	return SnapshotInfo{
+		Name: name,
+		Kind: kind,
+		CreatedAt: now,
+		Size: counter.n,
+		Checksum: sum,
+	}, nil
+}
+
+// List returns the snapshots in the directory, newest first.
+func (m *SnapshotManager) List() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(m.dir)
+	if os.IsNotExist(err) { return []SnapshotInfo{}, nil }
+	if err != nil { return nil, err }
+
+	out := []SnapshotInfo{}
+	for _, entry := range entries {
+		info, ok := parseSnapshotName(entry.Name())
+		if !ok { continue }
+
+		fileInfo, err := entry.Info()
+		if err != nil { return nil, err }
+		info.Size = fileInfo.Size()
+
+		info.Checksum, err = readChecksum(filepath.Join(m.dir, info.Name))
+		if err != nil { return nil, err }
+
+		out = append(out, info)
+	}
+
+	slices.SortFunc(out, func(a, b SnapshotInfo) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return out, nil
+}
+
+// Prune removes automatic snapshots past the retention limits.
+func (m *SnapshotManager) Prune() error {
+	snapshots, err := m.List()
+	if err != nil { return err }
+
+	kept := 0
+	for _, snapshot := range snapshots {
+		if snapshot.Kind != snapshotAuto { continue }
+
+		expired := m.maxAge > 0 && time.Since(snapshot.CreatedAt) > m.maxAge
+		if !expired && (m.keep <= 0 || kept < m.keep) {
+			kept++
+			continue
+		}
+
+		path := filepath.Join(m.dir, snapshot.Name)
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) { return err }
+		os.Remove(path + checksumExt)
+	}
+	return nil
+}
+
+// Run takes an automatic snapshot every interval until done is closed.
+func (m *SnapshotManager) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := m.Create(snapshotAuto)
+			if err != nil {
+				log.Printf("Error taking snapshot: %s", err)
+				continue
+			}
+			log.Printf("Took snapshot %s", info.Name)
+
+			err = m.Prune()
+			if err != nil { log.Printf("Error pruning snapshots: %s", err) }
+		case <-done:
+			return
+		}
+	}
+}
+
+// Path resolves a snapshot name, refusing anything outside the directory.
+func (m *SnapshotManager) Path(name string) (string, error) {
+	if _, ok := parseSnapshotName(name); !ok || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return filepath.Join(m.dir, name), nil
+}
+
+// RestoreSnapshot verifies the snapshot at path and unpacks it as a new json
+// database at dbPath, which must not exist yet.
+func RestoreSnapshot(path, dbPath string, opts DBOptions) (*DB, error) {
+	want, err := readChecksum(path)
+	if err != nil { return nil, err }
+
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil { return nil, err }
+	if hex.EncodeToString(hash.Sum(nil)) != want { return nil, ErrBadChecksum }
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil { return nil, err }
+
+	gz, err := gzip.NewReader(f)
+	if err != nil { return nil, err }
+	defer gz.Close()
+
+	out, err := os.OpenFile(dbPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil { return nil, err }
+
+	_, err = io.Copy(out, gz)
+	if err == nil { err = out.Sync() }
+	if cerr := out.Close(); err == nil { err = cerr }
+	if err != nil {
+		os.Remove(dbPath)
+		return nil, err
+	}
+
+	// a leftover log from an older database at this path must not be
+	// replayed over the restored one
+	err = os.Remove(dbPath + walSuffix)
+	if err != nil && !os.IsNotExist(err) { return nil, err }
+
+	return NewDBWithOptions(dbPath, opts)
+}
+
+func parseSnapshotName(name string) (SnapshotInfo, bool) {
+	base, ok := strings.CutSuffix(name, snapshotExt)
+	if !ok { return SnapshotInfo{}, false }
+
+	kind, stamp, ok := strings.Cut(base, "-")
+	if !ok || (kind != snapshotAuto && kind != snapshotManual) {
+		return SnapshotInfo{}, false
+	}
+
+	createdAt, err := time.Parse(snapshotTimeFormat, stamp)
+	if err != nil { return SnapshotInfo{}, false }
+
+	return SnapshotInfo{ Name: name, Kind: kind, CreatedAt: createdAt }, true
+}
+
+func readChecksum(path string) (string, error) {
+	f, err := os.Open(path + checksumExt)
+	if err != nil { return "", err }
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) { return "", err }
+
+	sum, _, _ := strings.Cut(line, " ")
+	return strings.TrimSpace(sum), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (cfg *apiConfig) snapshotPostHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.snapshots == nil {
+		respondWithError(w, http.StatusNotImplemented, "Store does not support snapshots")
+		return
+	}
+
+	info, err := cfg.snapshots.Create(snapshotManual)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, info)
+}
+
+func (cfg *apiConfig) snapshotGetHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.snapshots == nil {
+		respondWithError(w, http.StatusNotImplemented, "Store does not support snapshots")
+		return
+	}
+
+	snapshots, err := cfg.snapshots.List()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, snapshots)
+}
@@ -0,0 +1,722 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+// sqliteMigrations are applied in order on open, tracking progress in
+// PRAGMA user_version. The first one uses IF NOT EXISTS since it was run
+// unversioned before versioning existed.
+var sqliteMigrations = []string{`
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS chirps (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL,
+	body TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_nocase ON users (email COLLATE NOCASE);
+CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id, id);
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	revoked INTEGER NOT NULL DEFAULT 0,
+	revoked_at DATETIME
+);
+`, `
+ALTER TABLE refresh_tokens ADD COLUMN expires_at INTEGER;
+UPDATE refresh_tokens SET expires_at = CAST(strftime('%s', 'now') AS INTEGER) + 60 * 24 * 60 * 60;
+CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);
+`, `
+ALTER TABLE refresh_tokens ADD COLUMN family TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN rotated INTEGER NOT NULL DEFAULT 0;
+UPDATE refresh_tokens SET family = lower(hex(randomblob(16)));
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+`, `
+ALTER TABLE refresh_tokens ADD COLUMN user_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE refresh_tokens ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE refresh_tokens ADD COLUMN last_used_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+CREATE INDEX refresh_tokens_user_id ON refresh_tokens (user_id);
+`, `
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+`, `
+CREATE TABLE api_keys (
+	hash TEXT PRIMARY KEY,
+	id TEXT NOT NULL UNIQUE,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX api_keys_user_id ON api_keys (user_id);
+`, `
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '';
+`, `
+CREATE TABLE one_time_tokens (
+	hash TEXT PRIMARY KEY,
+	purpose TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX one_time_tokens_user_id ON one_time_tokens (user_id, purpose);
+`, `
+ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 0;
+UPDATE users SET verified = 1;
+`, `
+CREATE TABLE oauth_clients (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	secret_hash TEXT NOT NULL DEFAULT '',
+	redirect_uris TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX oauth_clients_user_id ON oauth_clients (user_id);
+`, `
+CREATE TABLE identities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+`, `
+ALTER TABLE one_time_tokens ADD COLUMN email TEXT NOT NULL DEFAULT '';
+`, `
+UPDATE refresh_tokens SET family = lower(hex(randomblob(16))) WHERE family = token;
+`, `
+UPDATE OR IGNORE users SET email = lower(trim(email));
+`,
+}
+
+const userColumns = `id, email, password, is_chirpy_red, role, verified,
+	totp_secret, totp_enabled, totp_last_step, recovery_codes`
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil { return nil, err }
+
+	// sqlite only allows one writer, so serialise everything through
+	// a single connection instead of fighting over the lock
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteDB{ db: db }
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SQLiteDB) migrate() error {
+	version := 0
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil { return err }
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf(
+			"database schema version %d is newer than the supported version %d",
+			version, len(sqliteMigrations))
+	}
+
+	for v := version; v < len(sqliteMigrations); v++ {
+		tx, err := s.db.Begin()
+		if err != nil { return err }
+
+		_, err = tx.Exec(sqliteMigrations[v])
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", v + 1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating to version %d: %w", v + 1, err)
+		}
+		if err := tx.Commit(); err != nil { return err }
+	}
+	return nil
+}
+
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// Emails are stored and looked up normalized, so they match the same way as
+// in the JSON store.
+
+func (s *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	email = normalizeEmail(email)
+	res, err := s.db.Exec(
+		"INSERT INTO users (email, password) VALUES (?, ?)", email, password)
+	if isUniqueViolation(err) { return User{}, ErrEmailInUse }
+	if err != nil { return User{}, err }
+
+	id, err := res.LastInsertId()
+	if err != nil { return User{}, err }
+
+	return User{
+		Email: email,
+		Password: password,
+		Id: int(id),
+		Role: RoleUser,
+	}, nil
+}
+
+func (s *SQLiteDB) UpdateUser(id int, email, password string) (User, error) {
+	email = normalizeEmail(email)
+	tx, err := s.db.Begin()
+	if err != nil { return User{}, err }
+	defer tx.Rollback()
+
+	var oldEmail string
+	err = tx.QueryRow("SELECT email FROM users WHERE id = ?", id).Scan(&oldEmail)
+	if errors.Is(err, sql.ErrNoRows) { return User{}, ErrNotExist }
+	if err != nil { return User{}, err }
+
+	_, err = tx.Exec(
+		`UPDATE users
+		SET verified = CASE WHEN ? = '' OR email = ? COLLATE NOCASE THEN verified ELSE 0 END,
+			email = COALESCE(NULLIF(?, ''), email),
+			password = COALESCE(NULLIF(?, ''), password)
+		WHERE id = ?`,
+		email, email, email, password, id)
+	if isUniqueViolation(err) { return User{}, ErrEmailInUse }
+	if err != nil { return User{}, err }
+
+	// links mailed to the old address shouldn't work any more
+	if email != "" && normalizeEmail(email) != normalizeEmail(oldEmail) {
+		_, err = tx.Exec("DELETE FROM one_time_tokens WHERE user_id = ?", id)
+		if err != nil { return User{}, err }
+	}
+
+	if err := tx.Commit(); err != nil { return User{}, err }
+	return s.GetUserFromId(id)
+}
+
+func (s *SQLiteDB) VerifyUser(id int) error {
+	res, err := s.db.Exec("UPDATE users SET verified = 1 WHERE id = ?", id)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func (s *SQLiteDB) UpgradeUser(id int) error {
+	res, err := s.db.Exec("UPDATE users SET is_chirpy_red = 1 WHERE id = ?", id)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func (s *SQLiteDB) SetUserRole(id int, role string) error {
+	res, err := s.db.Exec("UPDATE users SET role = ? WHERE id = ?", role, id)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func (s *SQLiteDB) SetUserPassword(id int, password string) error {
+	res, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ?", password, id)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func (s *SQLiteDB) SetUserTOTP(id int, totp TOTP) error {
+	res, err := s.db.Exec(
+		`UPDATE users SET totp_secret = ?, totp_enabled = ?, totp_last_step = ?, recovery_codes = ?
+		WHERE id = ?`,
+		totp.Secret, totp.Enabled, totp.LastStep, strings.Join(totp.RecoveryCodes, " "), id)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func (s *SQLiteDB) UseTOTPStep(id int, step int64) error {
+	res, err := s.db.Exec(
+		"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, id, step)
+	if err != nil { return err }
+
+	err = expectRow(res)
+	if errors.Is(err, ErrNotExist) {
+		if _, err := s.GetUserFromId(id); err != nil { return err }
+		return ErrCodeUsed
+	}
+	return err
+}
+
+func (s *SQLiteDB) UseRecoveryCode(id int, hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	var codes string
+	err = tx.QueryRow("SELECT recovery_codes FROM users WHERE id = ?", id).Scan(&codes)
+	if errors.Is(err, sql.ErrNoRows) { return ErrNotExist }
+	if err != nil { return err }
+
+	remaining := strings.Fields(codes)
+	i := slices.Index(remaining, hash)
+	if i < 0 { return ErrNotExist }
+	remaining = slices.Delete(remaining, i, i + 1)
+
+	_, err = tx.Exec("UPDATE users SET recovery_codes = ? WHERE id = ?",
+		strings.Join(remaining, " "), id)
+	if err != nil { return err }
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RemoveUser(id int) error {
+	_, err := s.db.Exec("DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLiteDB) GetUserFromId(id int) (User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT " + userColumns + " FROM users WHERE id = ?", id))
+}
+
+func (s *SQLiteDB) GetUserFromEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		"SELECT " + userColumns + " FROM users WHERE email = ? COLLATE NOCASE", normalizeEmail(email)))
+}
+
+func (s *SQLiteDB) CreateChirp(author int, body string) (Chirp, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO chirps (author_id, body) VALUES (?, ?)", author, body)
+	if err != nil { return Chirp{}, err }
+
+	id, err := res.LastInsertId()
+	if err != nil { return Chirp{}, err }
+
+	return Chirp{
+		AuthorId: author,
+		Body: body,
+		Id: int(id),
+	}, nil
+}
+
+func (s *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := s.db.QueryRow(
+		"SELECT id, author_id, body FROM chirps WHERE id = ?", id,
+	).Scan(&chirp.Id, &chirp.AuthorId, &chirp.Body)
+	if errors.Is(err, sql.ErrNoRows) { return Chirp{}, ErrNotExist }
+	if err != nil { return Chirp{}, err }
+
+	return chirp, nil
+}
+
+func (s *SQLiteDB) GetChirps() ([]Chirp, error) {
+	rows, err := s.db.Query("SELECT id, author_id, body FROM chirps ORDER BY id")
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	return scanChirps(rows)
+}
+
+func scanChirps(rows *sql.Rows) ([]Chirp, error) {
+	out := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		err := rows.Scan(&chirp.Id, &chirp.AuthorId, &chirp.Body)
+		if err != nil { return nil, err }
+		out = append(out, chirp)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteDB) GetChirpsByAuthor(author int) ([]Chirp, error) {
+	rows, err := s.db.Query(
+		"SELECT id, author_id, body FROM chirps WHERE author_id = ? ORDER BY id", author)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	return scanChirps(rows)
+}
+
+func (s *SQLiteDB) DeleteChirp(id int) error {
+	_, err := s.db.Exec("DELETE FROM chirps WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLiteDB) IsChirpAuthor(author, id int) bool {
+	chirp, err := s.GetChirp(id)
+	if err != nil { return false }
+
+	return chirp.AuthorId == author
+}
+
+const insertRefreshToken = `
+INSERT INTO refresh_tokens
+	(token, revoked, expires_at, family, user_id, created_at, last_used_at, user_agent, ip)
+VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?)`
+
+func (s *SQLiteDB) AddToken(token string, refreshToken RefreshToken) error {
+	_, err := s.db.Exec(insertRefreshToken + `
+		ON CONFLICT (token) DO UPDATE
+		SET revoked = 0, revoked_at = NULL, rotated = 0,
+			expires_at = excluded.expires_at, family = excluded.family,
+			user_id = excluded.user_id, created_at = excluded.created_at,
+			last_used_at = excluded.last_used_at, user_agent = excluded.user_agent,
+			ip = excluded.ip`,
+		refreshTokenArgs(token, refreshToken)...)
+	return err
+}
+
+func refreshTokenArgs(token string, t RefreshToken) []any {
+	return []any{
+		token, t.ExpiresAt.Unix(), t.Family, t.UserId, unixOrZero(t.CreatedAt),
+		unixOrZero(t.LastUsedAt), t.UserAgent, t.IP,
+	}
+}
+
+func (s *SQLiteDB) RotateToken(oldToken, newToken string, next RefreshToken) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	var family string
+	var revoked, rotated bool
+	var oldExpiresAt, createdAt int64
+	err = tx.QueryRow(
+		`SELECT family, revoked, rotated, expires_at, created_at
+		FROM refresh_tokens WHERE token = ?`,
+		oldToken,
+	).Scan(&family, &revoked, &rotated, &oldExpiresAt, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) { return ErrNotExist }
+	if err != nil { return err }
+
+	if rotated && !revoked {
+		_, err := tx.Exec(
+			"UPDATE refresh_tokens SET revoked = 1, revoked_at = ? WHERE family = ? AND revoked = 0",
+			time.Now(), family)
+		if err != nil { return err }
+		if err := tx.Commit(); err != nil { return err }
+		return ErrTokenReused
+	}
+	if revoked || oldExpiresAt <= time.Now().Unix() { return ErrRevokedToken }
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET rotated = 1 WHERE token = ?", oldToken)
+	if err != nil { return err }
+
+	next.Family = family
+	next.CreatedAt = fromUnix(createdAt)
+	if next.CreatedAt.IsZero() { next.CreatedAt = next.LastUsedAt }
+	_, err = tx.Exec(insertRefreshToken, refreshTokenArgs(newToken, next)...)
+	if err != nil { return err }
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeToken(token string) error {
+	_, err := s.db.Exec(
+		"UPDATE refresh_tokens SET revoked = 1, revoked_at = ? WHERE token = ?",
+		time.Now(), token)
+	return err
+}
+
+func (s *SQLiteDB) ValidToken(token string) bool {
+	valid := false
+	err := s.db.QueryRow(
+		"SELECT revoked = 0 AND rotated = 0 AND expires_at > ? FROM refresh_tokens WHERE token = ?",
+		time.Now().Unix(), token,
+	).Scan(&valid)
+	if err != nil { return false }
+
+	return valid
+}
+
+func (s *SQLiteDB) PurgeTokens(now time.Time) (int, error) {
+	res, err := s.db.Exec(
+		"DELETE FROM refresh_tokens WHERE revoked = 1 OR expires_at <= ?", now.Unix())
+	if err != nil { return 0, err }
+
+	n, err := res.RowsAffected()
+	if err != nil { return 0, err }
+
+	res, err = s.db.Exec("DELETE FROM one_time_tokens WHERE expires_at <= ?", now.Unix())
+	if err != nil { return 0, err }
+
+	m, err := res.RowsAffected()
+	return int(n + m), err
+}
+
+func (s *SQLiteDB) CreateOneTimeToken(hash string, token OneTimeToken) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM one_time_tokens WHERE user_id = ? AND purpose = ?",
+		token.UserId, token.Purpose)
+	if err != nil { return err }
+
+	_, err = tx.Exec(
+		"INSERT INTO one_time_tokens (hash, purpose, user_id, email, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hash, token.Purpose, token.UserId, token.Email, unixOrZero(token.ExpiresAt))
+	if err != nil { return err }
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) ConsumeOneTimeToken(hash, purpose string, now time.Time) (OneTimeToken, error) {
+	token := OneTimeToken{ Purpose: purpose }
+	var expiresAt int64
+	err := s.db.QueryRow(
+		"DELETE FROM one_time_tokens WHERE hash = ? AND purpose = ? RETURNING user_id, email, expires_at",
+		hash, purpose,
+	).Scan(&token.UserId, &token.Email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) { return OneTimeToken{}, ErrNotExist }
+	if err != nil { return OneTimeToken{}, err }
+
+	token.ExpiresAt = fromUnix(expiresAt)
+	if !now.Before(token.ExpiresAt) { return OneTimeToken{}, ErrNotExist }
+	return token, nil
+}
+
+func (s *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT family, created_at, last_used_at, expires_at, user_agent, ip
+		FROM refresh_tokens
+		WHERE user_id = ? AND revoked = 0 AND rotated = 0 AND expires_at > ?
+		ORDER BY last_used_at DESC`,
+		userId, time.Now().Unix())
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	out := []Session{}
+	for rows.Next() {
+		session := Session{}
+		var createdAt, lastUsedAt, expiresAt int64
+		err := rows.Scan(&session.Id, &createdAt, &lastUsedAt, &expiresAt,
+			&session.UserAgent, &session.IP)
+		if err != nil { return nil, err }
+
+		session.CreatedAt = fromUnix(createdAt)
+		session.LastUsedAt = fromUnix(lastUsedAt)
+		session.ExpiresAt = fromUnix(expiresAt)
+		out = append(out, session)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteDB) RevokeSession(userId int, id string) error {
+	res, err := s.db.Exec(
+		`UPDATE refresh_tokens SET revoked = 1, revoked_at = ?
+		WHERE family = ? AND revoked = 0 AND EXISTS (
+			SELECT 1 FROM refresh_tokens
+			WHERE family = ? AND user_id = ? AND revoked = 0 AND rotated = 0 AND expires_at > ?
+		)`,
+		time.Now(), id, id, userId, time.Now().Unix())
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func (s *SQLiteDB) RevokeSessions(userId int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil { return 0, err }
+	defer tx.Rollback()
+
+	live := 0
+	err = tx.QueryRow(
+		`SELECT count(*) FROM refresh_tokens
+		WHERE user_id = ? AND revoked = 0 AND rotated = 0 AND expires_at > ?`,
+		userId, time.Now().Unix(),
+	).Scan(&live)
+	if err != nil { return 0, err }
+
+	_, err = tx.Exec(
+		"UPDATE refresh_tokens SET revoked = 1, revoked_at = ? WHERE user_id = ? AND revoked = 0",
+		time.Now(), userId)
+	if err != nil { return 0, err }
+
+	return live, tx.Commit()
+}
+
+func (s *SQLiteDB) CreateAPIKey(hash string, key APIKey) error {
+	_, err := s.db.Exec(
+		`INSERT INTO api_keys (hash, id, user_id, name, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hash, key.Id, key.UserId, key.Name, strings.Join(key.Scopes, " "),
+		unixOrZero(key.CreatedAt), unixOrZero(key.ExpiresAt))
+	return err
+}
+
+const apiKeyColumns = "id, user_id, name, scopes, created_at, expires_at"
+
+func (s *SQLiteDB) GetAPIKey(hash string) (APIKey, error) {
+	row := s.db.QueryRow("SELECT " + apiKeyColumns + " FROM api_keys WHERE hash = ?", hash)
+	key, err := scanAPIKey(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) { return APIKey{}, ErrNotExist }
+	return key, err
+}
+
+func (s *SQLiteDB) GetAPIKeys(userId int) ([]APIKey, error) {
+	rows, err := s.db.Query(
+		"SELECT " + apiKeyColumns + " FROM api_keys WHERE user_id = ? ORDER BY created_at DESC",
+		userId)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	out := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows.Scan)
+		if err != nil { return nil, err }
+		out = append(out, key)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteAPIKey(userId int, id string) error {
+	res, err := s.db.Exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", id, userId)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+func scanAPIKey(scan func(dest ...any) error) (APIKey, error) {
+	key := APIKey{}
+	var scopes string
+	var createdAt, expiresAt int64
+	err := scan(&key.Id, &key.UserId, &key.Name, &scopes, &createdAt, &expiresAt)
+	if err != nil { return APIKey{}, err }
+
+	key.Scopes = strings.Fields(scopes)
+	key.CreatedAt = fromUnix(createdAt)
+	key.ExpiresAt = fromUnix(expiresAt)
+	return key, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() { return 0 }
+	return t.Unix()
+}
+
+func fromUnix(n int64) time.Time {
+	if n == 0 { return time.Time{} }
+	return time.Unix(n, 0).UTC()
+}
+
+func scanUser(row *sql.Row) (User, error) {
+	user := User{}
+	var recoveryCodes string
+	err := row.Scan(&user.Id, &user.Email, &user.Password, &user.IsChirpyRed, &user.Role, &user.Verified,
+		&user.TOTP.Secret, &user.TOTP.Enabled, &user.TOTP.LastStep, &recoveryCodes)
+	if errors.Is(err, sql.ErrNoRows) { return User{}, ErrNotExist }
+	if err != nil { return User{}, err }
+
+	user.TOTP.RecoveryCodes = strings.Fields(recoveryCodes)
+
+	return user, nil
+}
+
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil { return err }
+	if n == 0 { return ErrNotExist }
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+func (s *SQLiteDB) CreateOAuthClient(client OAuthClient) error {
+	_, err := s.db.Exec(
+		`INSERT INTO oauth_clients (id, user_id, name, secret_hash, redirect_uris, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		client.Id, client.UserId, client.Name, client.SecretHash,
+		strings.Join(client.RedirectURIs, " "), unixOrZero(client.CreatedAt))
+	return err
+}
+
+const oauthClientColumns = "id, user_id, name, secret_hash, redirect_uris, created_at"
+
+func (s *SQLiteDB) GetOAuthClient(id string) (OAuthClient, error) {
+	row := s.db.QueryRow("SELECT " + oauthClientColumns + " FROM oauth_clients WHERE id = ?", id)
+	client, err := scanOAuthClient(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) { return OAuthClient{}, ErrNotExist }
+	return client, err
+}
+
+func (s *SQLiteDB) GetOAuthClients(userId int) ([]OAuthClient, error) {
+	rows, err := s.db.Query(
+		"SELECT " + oauthClientColumns + " FROM oauth_clients WHERE user_id = ? ORDER BY created_at DESC",
+		userId)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	out := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows.Scan)
+		if err != nil { return nil, err }
+		out = append(out, client)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteOAuthClient(userId int, id string) error {
+	res, err := s.db.Exec("DELETE FROM oauth_clients WHERE id = ? AND user_id = ?", id, userId)
+	if err != nil { return err }
+
+	return expectRow(res)
+}
+
+// redirect uris can't contain spaces, so they're stored space separated
+// like scopes
+func scanOAuthClient(scan func(dest ...any) error) (OAuthClient, error) {
+	client := OAuthClient{}
+	var redirectURIs string
+	var createdAt int64
+	err := scan(&client.Id, &client.UserId, &client.Name, &client.SecretHash, &redirectURIs, &createdAt)
+	if err != nil { return OAuthClient{}, err }
+
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.CreatedAt = fromUnix(createdAt)
+	return client, nil
+}
+
+func (s *SQLiteDB) CreateIdentity(identity Identity) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO identities (provider, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		identity.Provider, identity.Subject, identity.UserId, identity.Email,
+		unixOrZero(identity.CreatedAt))
+	return err
+}
+
+func (s *SQLiteDB) GetIdentity(provider, subject string) (Identity, error) {
+	identity := Identity{ Provider: provider, Subject: subject }
+	var createdAt int64
+	err := s.db.QueryRow(
+		"SELECT user_id, email, created_at FROM identities WHERE provider = ? AND subject = ?",
+		provider, subject).Scan(&identity.UserId, &identity.Email, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) { return Identity{}, ErrNotExist }
+	if err != nil { return Identity{}, err }
+
+	identity.CreatedAt = fromUnix(createdAt)
+	return identity, nil
+}
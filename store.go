@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store is the persistence layer used by the api handlers. DB keeps
+// everything in a single json file, SQLiteDB keeps it in a sqlite database.
+type Store interface {
+	CreateUser(email string, password string) (User, error)
+	UpdateUser(id int, email, password string) (User, error)
+	UpgradeUser(id int) error
+	VerifyUser(id int) error
+	SetUserRole(id int, role string) error
+	SetUserPassword(id int, password string) error
+	SetUserTOTP(id int, totp TOTP) error
+	UseTOTPStep(id int, step int64) error
+	UseRecoveryCode(id int, hash string) error
+	RemoveUser(id int) error
+	GetUserFromId(id int) (User, error)
+	GetUserFromEmail(email string) (User, error)
+
+	CreateChirp(author int, body string) (Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpsByAuthor(author int) ([]Chirp, error)
+	DeleteChirp(id int) error
+	IsChirpAuthor(author, id int) bool
+
+	AddToken(token string, refreshToken RefreshToken) error
+	RotateToken(oldToken, newToken string, next RefreshToken) error
+	RevokeToken(token string) error
+	ValidToken(token string) bool
+	PurgeTokens(now time.Time) (int, error)
+
+	GetSessions(userId int) ([]Session, error)
+	RevokeSession(userId int, id string) error
+	RevokeSessions(userId int) (int, error)
+
+	CreateAPIKey(hash string, key APIKey) error
+	GetAPIKey(hash string) (APIKey, error)
+	GetAPIKeys(userId int) ([]APIKey, error)
+	DeleteAPIKey(userId int, id string) error
+
+	CreateOneTimeToken(hash string, token OneTimeToken) error
+	ConsumeOneTimeToken(hash, purpose string, now time.Time) (OneTimeToken, error)
+
+	CreateOAuthClient(client OAuthClient) error
+	GetOAuthClient(id string) (OAuthClient, error)
+	GetOAuthClients(userId int) ([]OAuthClient, error)
+	DeleteOAuthClient(userId int, id string) error
+
+	CreateIdentity(identity Identity) error
+	GetIdentity(provider, subject string) (Identity, error)
+
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
+var _ Store = (*SQLiteDB)(nil)
+
+const (
+	DriverJSON = "json"
+	DriverSQLite = "sqlite"
+)
+
+const defaultJSONPath = "database.json"
+const defaultSQLitePath = "database.db"
+
+// OpenStore opens the store for the given driver, defaulting to the json
+// file when driver is empty. opts only apply to the json file.
+func OpenStore(driver, path string, opts DBOptions) (Store, error) {
+	switch driver {
+	case "", DriverJSON:
+		if path == "" { path = defaultJSONPath }
+		return NewDBWithOptions(path, opts)
+	case DriverSQLite:
+		if path == "" { path = defaultSQLitePath }
+		return NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSweepInterval = time.Hour
+
+// tokenSweeper periodically purges refresh and one time tokens that can no
+// longer be used, and keeps count of what it did for the metrics page.
+type tokenSweeper struct {
+	store Store
+	sweeps atomic.Int64
+	collected atomic.Int64
+	lastSweep atomic.Int64
+}
+
+func newTokenSweeper(store Store) *tokenSweeper {
+	return &tokenSweeper{ store: store }
+}
+
+func (s *tokenSweeper) sweep() {
+	now := time.Now()
+	n, err := s.store.PurgeTokens(now)
+	if err != nil {
+		log.Printf("Error purging refresh tokens: %s", err)
+		return
+	}
+
+	s.sweeps.Add(1)
+	s.collected.Add(int64(n))
+	s.lastSweep.Store(now.Unix())
+}
+
+// run sweeps every interval until done is closed.
+func (s *tokenSweeper) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-done:
+			return
+		}
+	}
+}
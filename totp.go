@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Codes are RFC 6238 TOTP with the defaults every authenticator app
+// supports: HMAC-SHA1, 6 digits and a 30 second step. A code from the step
+// before or after the current one is accepted too, for clock drift.
+
+const (
+	totpIssuer = "Chirpy"
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew = 1
+	recoveryCodeCount = 10
+	mfaChallengeLifetime = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode is the code for a secret at a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil { return "", err }
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum) - 1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n % 1000000), nil
+}
+
+// checkTOTP returns the step a code is valid for at now, ok is false if it
+// isn't valid at all.
+func checkTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits { return 0, false }
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current + totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err != nil { return 0, false }
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(secret, email string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", strconv.Itoa(totpDigits))
+	values.Set("period", strconv.Itoa(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns the codes to show the user and the hashes to keep.
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := randomToken(5)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+// verifySecondFactor checks a TOTP code or, if that's empty, a recovery code
+// for the user, using either up.
+func (cfg *apiConfig) verifySecondFactor(user User, code, recoveryCode string) error {
+	if code == "" && recoveryCode != "" {
+		err := cfg.db.UseRecoveryCode(user.Id, hashRecoveryCode(recoveryCode))
+		if errors.Is(err, ErrNotExist) { return errors.New("invalid recovery code") }
+		return err
+	}
+
+	step, ok := checkTOTP(user.TOTP.Secret, code, cfg.now())
+	if !ok { return errors.New("invalid code") }
+
+	return cfg.db.UseTOTPStep(user.Id, step)
+}
+
+// respondWithMFAChallenge is the first half of logging in with 2FA on. The
+// challenge token only proves the password was right, it has to be sent back
+// to /api/login/mfa with a code to get real tokens.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user User) {
+	challenge, err := cfg.keys.SignedString(cfg.generateJWT("mfa", strconv.Itoa(user.Id)))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			MFARequired bool `json:"mfa_required"`
+			MFAToken string `json:"mfa_token"`
+		}{
+			MFARequired: true,
+			MFAToken: challenge,
+		})
+}
+
+func (cfg *apiConfig) loginMFAPostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken string `json:"mfa_token"`
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	claims, err := cfg.parseJWT(params.MFAToken, "mfa")
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	user, err := cfg.db.GetUserFromId(id)
+	if err != nil || !user.TOTP.Enabled {
+		respondWithError(w, http.StatusUnauthorized, "invalid mfa token")
+		return
+	}
+
+	// wrong codes count as failed logins, or the password alone would get
+	// unlimited guesses at a 6 digit code
+	keys := loginKeys(user.Email, r)
+	if !cfg.checkLoginAllowed(w, keys) { return }
+
+	err = cfg.verifySecondFactor(user, params.Code, params.RecoveryCode)
+	if err != nil {
+		cfg.limiter.fail(keys, cfg.now())
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	cfg.completeLogin(w, r, user)
+}
+
+// totpEnrollPostHandler starts enrolling, or starts over with a new secret if
+// an earlier attempt was never activated.
+func (cfg *apiConfig) totpEnrollPostHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	if user.TOTP.Enabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret := newTOTPSecret()
+	err := cfg.db.SetUserTOTP(user.Id, TOTP{ Secret: secret })
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			Secret string `json:"secret"`
+			ProvisioningURI string `json:"provisioning_uri"`
+		}{
+			Secret: secret,
+			ProvisioningURI: totpURI(secret, user.Email),
+		})
+}
+
+// totpActivatePostHandler turns 2FA on once the user shows a code from the
+// secret they enrolled, and hands out the recovery codes.
+func (cfg *apiConfig) totpActivatePostHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+	if user.TOTP.Enabled {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTP.Secret == "" {
+		respondWithError(w, http.StatusBadRequest, "Enroll before activating")
+		return
+	}
+
+	step, ok := checkTOTP(user.TOTP.Secret, params.Code, cfg.now())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "invalid code")
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	err = cfg.db.SetUserTOTP(user.Id, TOTP{
+		Secret: user.TOTP.Secret,
+		Enabled: true,
+		LastStep: step,
+		RecoveryCodes: hashes,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the recovery codes are only ever shown here
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{
+			RecoveryCodes: codes,
+		})
+}
+
+// totpDeleteHandler turns 2FA off, which takes a current code or a recovery
+// code so that a stolen access token isn't enough.
+func (cfg *apiConfig) totpDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	params, err := decodeParameters[parameters](r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, _ := UserFromContext(r.Context())
+	if !user.TOTP.Enabled {
+		respondWithError(w, http.StatusNotFound, "Two-factor authentication is not enabled")
+		return
+	}
+
+	// counted like failed logins, or a stolen token would get unlimited
+	// guesses at a 6 digit code
+	keys := loginKeys(user.Email, r)
+	if !cfg.checkLoginAllowed(w, keys) { return }
+
+	err = cfg.verifySecondFactor(user, params.Code, params.RecoveryCode)
+	if err != nil {
+		cfg.limiter.fail(keys, cfg.now())
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = cfg.db.SetUserTOTP(user.Id, TOTP{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
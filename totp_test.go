@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the secret from the RFC 6238 test vectors
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// testConfig is enough of a config to run the login handlers against a temp
+// database, with the clock stopped at *now.
+func testConfig(t *testing.T, now *time.Time) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "database.json"), DBOptions{})
+	t.Cleanup(func() { db.Close() })
+
+	keys, err := LoadKeySet(filepath.Join(dir, "jwt_keys.json"), AlgEdDSA, 0)
+	if err != nil { t.Fatal(err) }
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil { t.Fatal(err) }
+
+	return &apiConfig{
+		db: db,
+		keys: keys,
+		hasher: hasher,
+		limiter: newLoginLimiter(hasher),
+		clock: func() time.Time { return *now },
+	}
+}
+
+// testTOTPUser makes a user with 2FA on using the RFC secret and one known
+// recovery code.
+func testTOTPUser(t *testing.T, cfg *apiConfig, recoveryCode string) User {
+	t.Helper()
+	user, err := cfg.db.CreateUser("a@b.c", "hash")
+	if err != nil { t.Fatal(err) }
+	totp := TOTP{
+		Secret: rfcSecret,
+		Enabled: true,
+		RecoveryCodes: []string{ hashRecoveryCode(recoveryCode) },
+	}
+	if err := cfg.db.SetUserTOTP(user.Id, totp); err != nil { t.Fatal(err) }
+	user.TOTP = totp
+	return user
+}
+
+func mfaChallenge(t *testing.T, cfg *apiConfig, user User) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	cfg.respondWithMFAChallenge(w, user)
+	resp := struct{ MFAToken string `json:"mfa_token"` }{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil { t.Fatal(err) }
+	return resp.MFAToken
+}
+
+func postMFA(cfg *apiConfig, params map[string]string) int {
+	body, _ := json.Marshal(params)
+	r := httptest.NewRequest(http.MethodPost, "/api/login/mfa", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	cfg.loginMFAPostHandler(w, r)
+	return w.Code
+}
+
+func TestTOTPCode(t *testing.T) {
+	// the last 6 digits of the SHA1 vectors in RFC 6238 appendix B
+	for unix, want := range map[int64]string{
+		59: "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := totpCode(rfcSecret, totpStep(time.Unix(unix, 0)))
+		if err != nil { t.Fatal(err) }
+		if got != want { t.Errorf("code at %d is %s, want %s", unix, got, want) }
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := totpCode(rfcSecret, totpStep(now))
+	if err != nil { t.Fatal(err) }
+
+	for offset, ok := range map[time.Duration]bool{
+		0: true,
+		-totpPeriod * time.Second: true,
+		totpPeriod * time.Second: true,
+		-2 * totpPeriod * time.Second: false,
+		2 * totpPeriod * time.Second: false,
+	} {
+		step, valid := checkTOTP(rfcSecret, code, now.Add(offset))
+		if valid != ok { t.Errorf("code checked %s off was valid=%t, want %t", offset, valid, ok) }
+		if valid && step != totpStep(now) { t.Errorf("code checked %s off matched step %d, want %d", offset, step, totpStep(now)) }
+	}
+
+	if _, ok := checkTOTP(rfcSecret, "12345", now); ok { t.Error("a short code was accepted") }
+}
+
+func TestTOTPStepReuse(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	cfg := testConfig(t, &now)
+	user := testTOTPUser(t, cfg, "aaaaa-bbbbb")
+
+	code, err := totpCode(rfcSecret, totpStep(now))
+	if err != nil { t.Fatal(err) }
+	if status := postMFA(cfg, map[string]string{ "mfa_token": mfaChallenge(t, cfg, user), "code": code }); status != http.StatusOK {
+		t.Fatalf("first use of a code got %d", status)
+	}
+	if status := postMFA(cfg, map[string]string{ "mfa_token": mfaChallenge(t, cfg, user), "code": code }); status != http.StatusUnauthorized {
+		t.Fatalf("second use of a code got %d, want 401", status)
+	}
+
+	// a code from the step before is still in the window, but older than
+	// the one already used
+	earlier, err := totpCode(rfcSecret, totpStep(now) - 1)
+	if err != nil { t.Fatal(err) }
+	if status := postMFA(cfg, map[string]string{ "mfa_token": mfaChallenge(t, cfg, user), "code": earlier }); status != http.StatusUnauthorized {
+		t.Fatalf("code from an earlier step got %d, want 401", status)
+	}
+
+	now = now.Add(totpPeriod * time.Second)
+	next, err := totpCode(rfcSecret, totpStep(now))
+	if err != nil { t.Fatal(err) }
+	if status := postMFA(cfg, map[string]string{ "mfa_token": mfaChallenge(t, cfg, user), "code": next }); status != http.StatusOK {
+		t.Fatalf("code from the next step got %d", status)
+	}
+}
+
+func TestRecoveryCodeUsedOnce(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	cfg := testConfig(t, &now)
+	user := testTOTPUser(t, cfg, "aaaaa-bbbbb")
+
+	// recovery codes are matched however they're typed
+	if status := postMFA(cfg, map[string]string{ "mfa_token": mfaChallenge(t, cfg, user), "recovery_code": " AAAAABBBBB " }); status != http.StatusOK {
+		t.Fatalf("first use of a recovery code got %d", status)
+	}
+	if status := postMFA(cfg, map[string]string{ "mfa_token": mfaChallenge(t, cfg, user), "recovery_code": "aaaaa-bbbbb" }); status != http.StatusUnauthorized {
+		t.Fatalf("second use of a recovery code got %d, want 401", status)
+	}
+}
+
+func TestMFAChallengeExpires(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	cfg := testConfig(t, &now)
+	user := testTOTPUser(t, cfg, "aaaaa-bbbbb")
+
+	challenge := mfaChallenge(t, cfg, user)
+	now = now.Add(mfaChallengeLifetime + time.Second)
+	code, err := totpCode(rfcSecret, totpStep(now))
+	if err != nil { t.Fatal(err) }
+	if status := postMFA(cfg, map[string]string{ "mfa_token": challenge, "code": code }); status != http.StatusUnauthorized {
+		t.Fatalf("expired challenge got %d, want 401", status)
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 func (cfg *apiConfig) userPostHandler(w http.ResponseWriter, r *http.Request) {
@@ -19,77 +17,157 @@ func (cfg *apiConfig) userPostHandler(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
+	if problems := cfg.checkCredentials(params.Email, params.Password); len(problems) > 0 {
+		respondWithValidationErrors(w, problems)
+		return
+	}
 
-	encPass, err := bcrypt.GenerateFromPassword([]byte(params.Password), 0)
+	encPass, err := cfg.hasher.Hash(params.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "couldn't encrypt password")
+		return
 	}
 
-	user, err := cfg.db.CreateUser(params.Email, string(encPass))
+	user, err := cfg.db.CreateUser(params.Email, encPass)
 	if err != nil {
 		msg := fmt.Sprintf("Couldn't create user: %s", err)
 		respondWithError(w, http.StatusInternalServerError, msg)
 		return
 	}
+	cfg.sendVerification(user)
+
 	respondWithJSON(w, http.StatusCreated,
 		struct{
 			Id int `json:"id"`
 			Email string `json:"email"`
 			IsChirpyRed bool `json:"is_chirpy_red"`			
+			Role string `json:"role"`
+			Verified bool `json:"verified"`
 		}{
 			Id: user.Id,
 			Email: user.Email,
 			IsChirpyRed: user.IsChirpyRed,
+			Role: user.Role,
+			Verified: user.Verified,
 		},
 	)
 }
 
-func (cfg *apiConfig) userPutHandler(w http.ResponseWriter, r *http.Request) {
+// userPatchHandler changes the email, the password or both, leaving out
+// whichever isn't given. Either needs the current password as well, so a
+// stolen access token isn't enough to take over the account.
+func (cfg *apiConfig) userPatchHandler(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		Password string `json:"password"`
 		Email string `json:"email"`
+		Password string `json:"password"`
+		CurrentPassword string `json:"current_password"`
 	}
 
-	tok, err := GetBearerToken(r.Header)
+	authed, _ := UserFromContext(r.Context())
+
+	params, err := decodeParameters[parameters](r)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
-
-	idStr, err := cfg.validateJWT(tok, "access", cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	if params.Email == "" && params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Nothing to update")
 		return
 	}
 
-	id, err := strconv.Atoi(idStr)
-
-	params, err := decodeParameters[parameters](r)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	problems := []ValidationError{}
+	email := authed.Email
+	if params.Email != "" {
+		email = params.Email
+		if !validEmail(email) {
+			problems = append(problems, ValidationError{
+				Field: "email", Code: "invalid", Message: "Invalid email address",
+			})
+		}
+	}
+	if params.Password != "" {
+		problems = append(problems, cfg.policy.Check(params.Password, email)...)
+	}
+	if params.CurrentPassword == "" {
+		problems = append(problems, ValidationError{
+			Field: "current_password", Code: "required",
+			Message: "Your current password is needed to change your email or password",
+		})
+	}
+	if len(problems) > 0 {
+		respondWithValidationErrors(w, problems)
 		return
 	}
 
-	encPass, err := bcrypt.GenerateFromPassword([]byte(params.Password), 0)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if !cfg.confirmPassword(w, r, authed, params.CurrentPassword) { return }
+	cfg.limiter.clear(lockoutAccount, normalizeEmail(authed.Email))
+
+	encPass := ""
+	if params.Password != "" {
+		encPass, err = cfg.hasher.Hash(params.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 	}
 
-	user, err := cfg.db.UpdateUser(id, params.Email, string(encPass))
+	user, err := cfg.db.UpdateUser(authed.Id, params.Email, encPass)
+	if errors.Is(err, ErrEmailInUse) {
+		respondWithError(w, http.StatusConflict, "Email is already in use")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	// a new address needs verifying again, and sending a new link stops
+	// one sent to the old address from verifying it
+	if normalizeEmail(user.Email) != normalizeEmail(authed.Email) { cfg.sendVerification(user) }
 
 	respondWithJSON(w, http.StatusOK, 
 		struct{
 			Id int `json:"id"`
 			Email string `json:"email"`
 			IsChirpyRed bool `json:"is_chirpy_red"`
+			Role string `json:"role"`
+			Verified bool `json:"verified"`
 		}{
 			Id: user.Id,
 			Email: user.Email,
 			IsChirpyRed: user.IsChirpyRed,
+			Role: user.Role,
+			Verified: user.Verified,
 		},
 	)
 }
+
+// checkCredentials returns everything wrong with a new email and password.
+func (cfg *apiConfig) checkCredentials(email, password string) []ValidationError {
+	problems := []ValidationError{}
+	if !validEmail(email) {
+		problems = append(problems, ValidationError{
+			Field: "email", Code: "invalid", Message: "Invalid email address",
+		})
+	}
+	return append(problems, cfg.policy.Check(password, email)...)
+}
+
+// confirmPassword checks the logged in user's current password before a
+// sensitive change, responding and returning false if it's wrong. Wrong
+// guesses count towards locking the account like failed logins, the caller
+// clears the count once everything else it asks for checks out too.
+func (cfg *apiConfig) confirmPassword(w http.ResponseWriter, r *http.Request, user User, password string) bool {
+	keys := loginKeys(user.Email, r)
+	if !cfg.checkLoginAllowed(w, keys) { return false }
+	ok, err := verifyPassword(user.Password, password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if !ok {
+		cfg.limiter.fail(keys, cfg.now())
+		respondWithError(w, http.StatusUnauthorized, "Current password is incorrect")
+		return false
+	}
+	return true
+}
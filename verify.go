@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"slices"
+	"time"
+)
+
+const purposeVerifyEmail = "verify_email"
+const verifyEmailLifetime = 48 * time.Hour
+
+// Things unverified users can be kept from doing, picked with the
+// REQUIRE_VERIFIED env var.
+const (
+	verifiedChirps = "chirps"
+	verifiedAPIKeys = "apikeys"
+)
+
+// validEmail only accepts a bare address, not one with a display name.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// sendVerification mails the user a verification link in the background.
+func (cfg *apiConfig) sendVerification(user User) {
+	go func() {
+		err := cfg.sendOneTimeToken(user, purposeVerifyEmail, verifyEmailLifetime,
+			"/api/verify", "Verify your Chirpy email address",
+			"Follow this link to confirm this is your email address:")
+		if err != nil { log.Printf("Error sending verification to user %d: %s", user.Id, err) }
+	}()
+}
+
+// requireVerified responds with an error and returns false if user isn't
+// verified and what they're doing is restricted to verified users.
+func (cfg *apiConfig) requireVerified(w http.ResponseWriter, user User, action string) bool {
+	if user.Verified || !slices.Contains(cfg.verifiedOnly, action) { return true }
+
+	respondWithError(w, http.StatusForbidden, "Verify your email address first")
+	return false
+}
+
+// verifiedOnlyFromEnv reads REQUIRE_VERIFIED, a comma separated list that
+// defaults to just chirps. "none" lets unverified users do everything.
+func verifiedOnlyFromEnv() ([]string, error) {
+	str, ok := os.LookupEnv("REQUIRE_VERIFIED")
+	if !ok { return []string{ verifiedChirps }, nil }
+
+	actions := splitList(str)
+	if slices.Equal(actions, []string{ "none" }) { return []string{}, nil }
+
+	for _, action := range actions {
+		if action != verifiedChirps && action != verifiedAPIKeys {
+			return nil, fmt.Errorf("REQUIRE_VERIFIED: unknown action %q", action)
+		}
+	}
+	return actions, nil
+}
+
+// verifyGetHandler is where the link in the verification mail goes.
+func (cfg *apiConfig) verifyGetHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := cfg.db.ConsumeOneTimeToken(
+		hashToken(r.URL.Query().Get("token")), purposeVerifyEmail, cfg.now())
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the token only proves the address it was sent to, which isn't the
+	// user's any more if they've changed it since
+	user, err := cfg.db.GetUserFromId(token.UserId)
+	if errors.Is(err, ErrNotExist) || (err == nil && normalizeEmail(user.Email) != normalizeEmail(token.Email)) {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cfg.db.VerifyUser(user.Id)
+	if errors.Is(err, ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK,
+		struct{
+			Verified bool `json:"verified"`
+		}{
+			Verified: true,
+		})
+}
+
+func (cfg *apiConfig) verifyResendPostHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	if user.Verified {
+		respondWithError(w, http.StatusConflict, "Email address is already verified")
+		return
+	}
+
+	cfg.sendVerification(user)
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
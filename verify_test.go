@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testMailer keeps what would have been mailed.
+type testMailer struct {
+	sent []Mail
+}
+
+func (m *testMailer) Send(mail Mail) error {
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+var mailedToken = regexp.MustCompile(`token=([^\s]+)`)
+
+// TestVerificationTokenBoundToEmail checks a verification link stops working
+// once the user changes their email, since it was sent to the old one.
+func TestVerificationTokenBoundToEmail(t *testing.T) {
+	for _, driver := range []string{ DriverJSON, DriverSQLite } {
+		t.Run(driver, func(t *testing.T) {
+			db, err := OpenStore(driver, filepath.Join(t.TempDir(), "database"), DBOptions{})
+			if err != nil { t.Fatal(err) }
+			t.Cleanup(func() { db.Close() })
+
+			mailer := &testMailer{}
+			cfg := &apiConfig{ db: db, mailer: mailer, publicURL: "http://chirpy.test" }
+			verify := func(token string) int {
+				w := httptest.NewRecorder()
+				cfg.verifyGetHandler(w, httptest.NewRequest(http.MethodGet, "/api/verify?" + url.Values{ "token": { token } }.Encode(), nil))
+				return w.Code
+			}
+
+			user, err := db.CreateUser("old@b.c", "hash")
+			if err != nil { t.Fatal(err) }
+			err = cfg.sendOneTimeToken(user, purposeVerifyEmail, time.Hour, "/api/verify", "", "")
+			if err != nil { t.Fatal(err) }
+
+			user, err = db.UpdateUser(user.Id, "new@b.c", "")
+			if err != nil { t.Fatal(err) }
+			token, err := url.QueryUnescape(mailedToken.FindStringSubmatch(mailer.sent[0].Body)[1])
+			if err != nil { t.Fatal(err) }
+			if status := verify(token); status != http.StatusUnauthorized {
+				t.Fatalf("token for the old address got %d, want 401", status)
+			}
+			if user, _ := db.GetUserFromId(user.Id); user.Verified { t.Fatal("new address was verified by the old token") }
+
+			err = cfg.sendOneTimeToken(user, purposeVerifyEmail, time.Hour, "/api/verify", "", "")
+			if err != nil { t.Fatal(err) }
+			token, err = url.QueryUnescape(mailedToken.FindStringSubmatch(mailer.sent[1].Body)[1])
+			if err != nil { t.Fatal(err) }
+			if status := verify(token); status != http.StatusOK { t.Fatalf("token for the new address got %d", status) }
+			if user, _ := db.GetUserFromId(user.Id); !user.Verified { t.Fatal("new address wasn't verified") }
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The json database is stored as a snapshot file (db.path) plus an append
+// only log (db.path + ".wal") of every mutation since that snapshot. Each
+// line in the log is one committed record, so a crash can at worst leave a
+// half written last line which is dropped on replay. Once the log grows past
+// compactThreshold records it's folded into a fresh snapshot.
+
+const walSuffix = ".wal"
+const compactThreshold = 500
+
+const (
+	opPut = "put"
+	opDelete = "del"
+)
+
+const (
+	tableUsers = "users"
+	tableChirps = "chirps"
+	tableTokens = "tokens"
+	tableAPIKeys = "api_keys"
+	tableOneTimeTokens = "one_time_tokens"
+	tableOAuthClients = "oauth_clients"
+	tableIdentities = "identities"
+	tableSequences = "sequences"
+)
+
+type logEntry struct {
+	Op string `json:"op"`
+	Table string `json:"table"`
+	Key string `json:"key"`
+	Value any `json:"value,omitempty"`
+}
+
+type logRecord struct {
+	Entries []logEntry `json:"entries"`
+}
+
+type rawLogEntry struct {
+	Op string `json:"op"`
+	Table string `json:"table"`
+	Key string `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type rawLogRecord struct {
+	Entries []rawLogEntry `json:"entries"`
+}
+
+func putEntry(table string, key any, value any) logEntry {
+	return logEntry{ Op: opPut, Table: table, Key: fmt.Sprint(key), Value: value }
+}
+
+func deleteEntry(table string, key any) logEntry {
+	return logEntry{ Op: opDelete, Table: table, Key: fmt.Sprint(key) }
+}
+
+func (db *DB) logPath() string {
+	return db.path + walSuffix
+}
+
+// writeLog records one transaction, made of one or more entries, and syncs
+// it to disk unless syncing is batched. Callers must hold db.mu for writing.
+func (db *DB) writeLog(entries ...logEntry) error {
+	dat, err := json.Marshal(logRecord{ Entries: entries })
+	if err != nil { return err }
+
+	dat, err = db.opts.Keys.sealRecord(dat)
+	if err != nil { return err }
+	dat = append(dat, '\n')
+
+	if _, err := db.log.Write(dat); err != nil { return err }
+	if db.opts.SyncInterval > 0 {
+		// syncLoop picks it up on the next tick
+		db.dirty.Store(true)
+	} else if err := db.log.Sync(); err != nil {
+		return err
+	}
+
+	db.logRecords++
+	db.stampFiles()
+	return nil
+}
+
+// compact writes the in memory state out as a new snapshot and empties the
+// log. Entries are idempotent, so crashing between the two steps only means
+// the old log gets replayed over the new snapshot again. Callers must hold
+// db.mu for writing.
+func (db *DB) compact() error {
+	if err := db.writeDB(db.state); err != nil { return err }
+	if err := db.log.Truncate(0); err != nil { return err }
+
+	db.logRecords = 0
+	db.stampFiles()
+	return nil
+}
+
+// replayLog applies every complete record in the log to dbs and returns how
+// many were applied.
+func (db *DB) replayLog(dbs *DBStructure, r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	n := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// anything left without a newline is a write that never finished
+			return n, nil
+		}
+		if err != nil { return n, err }
+
+		line, keyId, err := db.opts.Keys.openRecord(line)
+		if err != nil { return n, fmt.Errorf("log record %d: %w", n + 1, err) }
+		if !db.opts.Keys.fresh(keyId) { db.stale = true }
+
+		record := rawLogRecord{}
+		err = json.Unmarshal(line, &record)
+		if err != nil { return n, fmt.Errorf("corrupt log record %d: %w", n + 1, err) }
+
+		for _, entry := range record.Entries {
+			err := dbs.apply(entry)
+			if err != nil { return n, fmt.Errorf("log record %d: %w", n + 1, err) }
+		}
+		n++
+	}
+}
+
+func (dbs *DBStructure) apply(entry rawLogEntry) error {
+	switch entry.Table {
+	case tableUsers:
+		return applyEntry(dbs.Users, entry, strconv.Atoi)
+	case tableChirps:
+		return applyEntry(dbs.Chirps, entry, strconv.Atoi)
+	case tableTokens:
+		return applyEntry(dbs.Tokens, entry, stringKey)
+	case tableAPIKeys:
+		return applyEntry(dbs.APIKeys, entry, stringKey)
+	case tableOneTimeTokens:
+		return applyEntry(dbs.OneTimeTokens, entry, stringKey)
+	case tableOAuthClients:
+		return applyEntry(dbs.OAuthClients, entry, stringKey)
+	case tableIdentities:
+		return applyEntry(dbs.Identities, entry, stringKey)
+	case tableSequences:
+		return applyEntry(dbs.Sequences, entry, stringKey)
+	default:
+		return fmt.Errorf("unknown table %q", entry.Table)
+	}
+}
+
+func applyEntry[K comparable, V any](table map[K]V, entry rawLogEntry, parseKey func(string) (K, error)) error {
+	key, err := parseKey(entry.Key)
+	if err != nil { return err }
+
+	switch entry.Op {
+	case opPut:
+		var value V
+		err := json.Unmarshal(entry.Value, &value)
+		if err != nil { return err }
+		table[key] = value
+		return nil
+	case opDelete:
+		delete(table, key)
+		return nil
+	default:
+		return fmt.Errorf("unknown log op %q", entry.Op)
+	}
+}
+
+func stringKey(s string) (string, error) {
+	return s, nil
+}
+
+// Tx is what an Update works on. Reads go straight to the state, writes go
+// through the put and delete methods, which change the state in place and
+// record the log entry and how to undo it. That way a write costs as much as
+// what it changes rather than the size of the database.
+type Tx struct {
+	*DBStructure
+	entries []logEntry
+	undo []func()
+	// index changes, made once the transaction has committed
+	reindex []func(*dbIndexes)
+}
+
+func txPut[K comparable, V any](tx *Tx, table string, rows map[K]V, key K, value V) {
+	old, ok := rows[key]
+	tx.undo = append(tx.undo, func() {
+		if ok { rows[key] = old } else { delete(rows, key) }
+	})
+	rows[key] = value
+	tx.entries = append(tx.entries, putEntry(table, key, value))
+}
+
+func txDelete[K comparable, V any](tx *Tx, table string, rows map[K]V, key K) {
+	old, ok := rows[key]
+	if !ok { return }
+
+	tx.undo = append(tx.undo, func() { rows[key] = old })
+	delete(rows, key)
+	tx.entries = append(tx.entries, deleteEntry(table, key))
+}
+
+// rollback undoes every write in the transaction, newest first.
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
+
+func (tx *Tx) putUser(id int, user User) {
+	old, ok := tx.Users[id]
+	txPut(tx, tableUsers, tx.Users, id, user)
+	tx.reindex = append(tx.reindex, func(idx *dbIndexes) {
+		if ok { idx.removeUser(id, old) }
+		idx.addUser(id, user)
+	})
+}
+
+func (tx *Tx) deleteUser(id int) {
+	old, ok := tx.Users[id]
+	if !ok { return }
+
+	txDelete(tx, tableUsers, tx.Users, id)
+	tx.reindex = append(tx.reindex, func(idx *dbIndexes) { idx.removeUser(id, old) })
+}
+
+func (tx *Tx) putChirp(id int, chirp Chirp) {
+	old, ok := tx.Chirps[id]
+	txPut(tx, tableChirps, tx.Chirps, id, chirp)
+	tx.reindex = append(tx.reindex, func(idx *dbIndexes) {
+		if ok { idx.removeChirp(old.AuthorId, id) }
+		idx.addChirp(chirp.AuthorId, id)
+	})
+}
+
+func (tx *Tx) deleteChirp(id int) {
+	old, ok := tx.Chirps[id]
+	if !ok { return }
+
+	txDelete(tx, tableChirps, tx.Chirps, id)
+	tx.reindex = append(tx.reindex, func(idx *dbIndexes) { idx.removeChirp(old.AuthorId, id) })
+}
+
+func (tx *Tx) putToken(token string, refreshToken RefreshToken) {
+	txPut(tx, tableTokens, tx.Tokens, token, refreshToken)
+}
+
+func (tx *Tx) deleteToken(token string) {
+	txDelete(tx, tableTokens, tx.Tokens, token)
+}
+
+func (tx *Tx) putAPIKey(hash string, key APIKey) {
+	txPut(tx, tableAPIKeys, tx.APIKeys, hash, key)
+}
+
+func (tx *Tx) deleteAPIKey(hash string) {
+	txDelete(tx, tableAPIKeys, tx.APIKeys, hash)
+}
+
+func (tx *Tx) putOneTimeToken(hash string, token OneTimeToken) {
+	txPut(tx, tableOneTimeTokens, tx.OneTimeTokens, hash, token)
+}
+
+func (tx *Tx) deleteOneTimeToken(hash string) {
+	txDelete(tx, tableOneTimeTokens, tx.OneTimeTokens, hash)
+}
+
+func (tx *Tx) putOAuthClient(id string, client OAuthClient) {
+	txPut(tx, tableOAuthClients, tx.OAuthClients, id, client)
+}
+
+func (tx *Tx) deleteOAuthClient(id string) {
+	txDelete(tx, tableOAuthClients, tx.OAuthClients, id)
+}
+
+func (tx *Tx) putIdentity(key string, identity Identity) {
+	txPut(tx, tableIdentities, tx.Identities, key, identity)
+}
+
+func (tx *Tx) nextId(table string) int {
+	id := tx.Sequences[table] + 1
+	txPut(tx, tableSequences, tx.Sequences, table, id)
+	return id
+}